@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+const (
+	defaultDNSSuffix = "lvdev"
+	defaultDNSListen = "127.0.0.1:53535"
+	dnsTTL           = 5 // seconds, addresses change with the domains
+	dnsRefresh       = time.Minute
+	dnsStartDelay    = 10 * time.Second // started domains need time to get an address
+	dnsUDPSize       = 512
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeOK       = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+)
+
+// dnsServer answers A and AAAA queries for <name>.<suffix> from a cache of domain addresses
+type dnsServer struct {
+	suffix  string
+	mu      sync.RWMutex
+	records map[string][]netip.Addr
+}
+
+func (c *Config) GetDNSSuffix() string {
+	if c.DNSSuffix == "" {
+		return defaultDNSSuffix
+	}
+	return strings.ToLower(strings.Trim(c.DNSSuffix, "."))
+}
+
+func (c *Config) GetDNSListen() string {
+	if c.DNSListen == "" {
+		return defaultDNSListen
+	}
+	return c.DNSListen
+}
+
+func newDNSServer(suffix string) *dnsServer {
+	return &dnsServer{suffix: strings.ToLower(strings.Trim(suffix, ".")), records: map[string][]netip.Addr{}}
+}
+
+func (s *dnsServer) setRecords(records map[string][]netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+}
+
+func (s *dnsServer) lookup(name string) ([]netip.Addr, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs, ok := s.records[name]
+	return addrs, ok
+}
+
+// parseDNSName reads the uncompressed query name at off, returning it lowercased without the trailing dot
+func parseDNSName(msg []byte, off int) (string, int, error) {
+	labels := []string{}
+	for {
+		if off >= len(msg) {
+			return "", 0, errors.New("dns name out of bounds")
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			return strings.ToLower(strings.Join(labels, ".")), off, nil
+		} else if n&0xc0 != 0 {
+			return "", 0, errors.New("compressed dns name in question")
+		} else if off+n > len(msg) {
+			return "", 0, errors.New("dns label out of bounds")
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+}
+
+// answer builds the response to a query, nil for messages that aren't worth an answer
+func (s *dnsServer) answer(req []byte, maxSize int) []byte {
+	if len(req) < 12 || req[2]&0x80 != 0 {
+		// too short or not a query
+		return nil
+	}
+	resp := make([]byte, 12, dnsUDPSize)
+	copy(resp, req[:2])
+	resp[2] = 0x80 | 0x04 | req[2]&0x01 // QR, AA and the query's RD
+	if opcode := req[2] >> 3 & 0x0f; opcode != 0 {
+		resp[3] = dnsRcodeNotImp
+		return resp
+	} else if binary.BigEndian.Uint16(req[4:6]) != 1 {
+		resp[3] = dnsRcodeFormErr
+		return resp
+	}
+	name, off, err := parseDNSName(req, 12)
+	if err != nil || off+4 > len(req) {
+		resp[3] = dnsRcodeFormErr
+		return resp
+	}
+	qtype, qclass := binary.BigEndian.Uint16(req[off:]), binary.BigEndian.Uint16(req[off+2:])
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	resp = append(resp, req[12:off+4]...)
+	if name != s.suffix && !strings.HasSuffix(name, "."+s.suffix) {
+		resp[3] = dnsRcodeRefused
+		return resp
+	}
+	addrs, ok := s.lookup(name)
+	if !ok && name != s.suffix {
+		resp[3] = dnsRcodeNXDomain
+		return resp
+	}
+	answers := uint16(0)
+	for _, addr := range addrs {
+		if qclass != dnsClassIN || (qtype == dnsTypeA) != addr.Is4() || (qtype != dnsTypeA && qtype != dnsTypeAAAA) {
+			continue
+		}
+		rr := binary.BigEndian.AppendUint16(nil, 0xc00c) // pointer to the question name
+		rr = binary.BigEndian.AppendUint16(rr, qtype)
+		rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+		rr = binary.BigEndian.AppendUint32(rr, dnsTTL)
+		rr = binary.BigEndian.AppendUint16(rr, uint16(addr.BitLen()/8))
+		rr = append(rr, addr.AsSlice()...)
+		if len(resp)+len(rr) > maxSize {
+			resp[2] |= 0x02 // TC, the client retries over tcp
+			break
+		}
+		resp = append(resp, rr...)
+		answers++
+	}
+	binary.BigEndian.PutUint16(resp[6:8], answers)
+	return resp
+}
+
+func (s *dnsServer) serveUDP(pc net.PacketConn) error {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if resp := s.answer(buf[:n], dnsUDPSize); resp != nil {
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				log.Printf("WARN: dns reply to %s: %v", addr, err)
+			}
+		}
+	}
+}
+
+func (s *dnsServer) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				size := make([]byte, 2)
+				if _, err := io.ReadFull(conn, size); err != nil {
+					return
+				}
+				req := make([]byte, binary.BigEndian.Uint16(size))
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				resp := s.answer(req, 0xffff)
+				if resp == nil {
+					return
+				} else if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// dnsRecords maps <domain>.<suffix> and <alias>.<suffix> (NetDNSHostnames) to the addresses of running domains
+func (c *Config) dnsRecords() (map[string][]netip.Addr, error) {
+	doms, err := c.conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, dom := range doms {
+			dom.Free()
+		}
+	}()
+	suffix := c.GetDNSSuffix()
+	records := map[string][]netip.Addr{}
+	for _, dom := range doms {
+		domName, err := dom.GetName()
+		if err != nil {
+			return nil, err
+		}
+		domAddrs, err := c.getDomainIPAddresses(&dom)
+		if err != nil {
+			if c.Verbose {
+				log.Printf("no dns records for domain %q: %v", domName, err)
+			}
+			continue
+		}
+		addrs := []netip.Addr{}
+		for _, domAddr := range domAddrs {
+			if addr, err := netip.ParseAddr(domAddr.Addr); err == nil {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+		for _, name := range append([]string{domName}, c.NetDNSHostnames[domName]...) {
+			records[strings.ToLower(name)+"."+suffix] = addrs
+		}
+	}
+	return records, nil
+}
+
+// initEventLoop registers libvirt's event loop, it must run before the connection is opened
+func initEventLoop() error {
+	if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			if err := libvirt.EventRunDefaultImpl(); err != nil {
+				log.Printf("WARN: libvirt event loop: %v", err)
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
+// serveDNS runs the dns server for the domain suffix until ctx is done
+func (c *Config) serveDNS(ctx context.Context) error {
+	s := newDNSServer(c.GetDNSSuffix())
+	refresh := make(chan time.Duration, 16)
+	callbackID, err := c.conn.DomainEventLifecycleRegister(nil, func(_ *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		if c.Verbose {
+			domName, _ := d.GetName()
+			log.Printf("domain %q lifecycle event %v", domName, event)
+		}
+		select {
+		case refresh <- 0:
+		default:
+		}
+		if event.Event == libvirt.DOMAIN_EVENT_STARTED {
+			select {
+			case refresh <- dnsStartDelay:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer c.conn.DomainEventDeregister(callbackID)
+
+	listen := c.GetDNSListen()
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	errs := make(chan error, 2)
+	go func() { errs <- s.serveUDP(pc) }()
+	go func() { errs <- s.serveTCP(l) }()
+	log.Printf("serving dns for *.%s on %s (udp and tcp)", s.suffix, listen)
+
+	update := func() {
+		records, err := c.dnsRecords()
+		if err != nil {
+			log.Printf("WARN: dns records error: %v", err)
+			return
+		}
+		s.setRecords(records)
+		log.Printf("dns records updated (%d names)", len(records))
+	}
+	update()
+	ticker := time.NewTicker(dnsRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return fmt.Errorf("dns server: %w", err)
+		case <-ticker.C:
+			update()
+		case delay := <-refresh:
+			if delay > 0 {
+				time.AfterFunc(delay, func() {
+					select {
+					case refresh <- 0:
+					default:
+					}
+				})
+				continue
+			}
+			update()
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestDNSServer serves the records on a local udp and tcp port, returning a resolver using it
+func startTestDNSServer(t *testing.T, records map[string][]netip.Addr) (*net.Resolver, string) {
+	t.Helper()
+	s := newDNSServer("lvdev")
+	s.setRecords(records)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.serveUDP(pc)
+	go s.serveTCP(l)
+	addr := pc.LocalAddr().String()
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	return resolver, addr
+}
+
+func TestDNSServerLookup(t *testing.T) {
+	resolver, _ := startTestDNSServer(t, map[string][]netip.Addr{
+		"web.lvdev": {netip.MustParseAddr("192.168.125.10"), netip.MustParseAddr("fd00:1::10")},
+		"db.lvdev":  {netip.MustParseAddr("192.168.125.11")},
+	})
+	tests := []struct {
+		network string
+		name    string
+		want    []string
+	}{
+		{"ip4", "web.lvdev.", []string{"192.168.125.10"}},
+		{"ip6", "web.lvdev.", []string{"fd00:1::10"}},
+		{"ip", "WEB.lvdev.", []string{"192.168.125.10", "fd00:1::10"}},
+		{"ip4", "db.lvdev.", []string{"192.168.125.11"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network+" "+tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			addrs, err := resolver.LookupNetIP(ctx, tt.network, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, addr := range addrs {
+				got = append(got, addr.String())
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("LookupNetIP(%s, %s) = %v, want %v", tt.network, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSServerNXDomain(t *testing.T) {
+	resolver, _ := startTestDNSServer(t, map[string][]netip.Addr{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := resolver.LookupNetIP(ctx, "ip4", "missing.lvdev.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupNetIP(missing.lvdev.) error = %v, want not found", err)
+	}
+}
+
+// dnsQuery builds an A query for name
+func dnsQuery(id uint16, name string) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0) // RD, one question
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeA)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN)
+}
+
+func TestDNSServerRcodes(t *testing.T) {
+	_, addr := startTestDNSServer(t, map[string][]netip.Addr{
+		"web.lvdev": {netip.MustParseAddr("192.168.125.10")},
+	})
+	tests := []struct {
+		name    string
+		rcode   byte
+		answers uint16
+	}{
+		{"web.lvdev", dnsRcodeOK, 1},
+		{"missing.lvdev", dnsRcodeNXDomain, 0},
+		{"example.com", dnsRcodeRefused, 0},
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := uint16(0x1000 + i)
+			if _, err := conn.Write(dnsQuery(id, tt.name)); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp := make([]byte, dnsUDPSize)
+			n, err := conn.Read(resp)
+			if err != nil {
+				t.Fatal(err)
+			} else if n < 12 {
+				t.Fatalf("response is %d bytes", n)
+			}
+			if got := binary.BigEndian.Uint16(resp); got != id {
+				t.Errorf("id = %#x, want %#x", got, id)
+			}
+			if rcode := resp[3] & 0x0f; rcode != tt.rcode {
+				t.Errorf("rcode = %d, want %d", rcode, tt.rcode)
+			}
+			if answers := binary.BigEndian.Uint16(resp[6:8]); answers != tt.answers {
+				t.Errorf("answers = %d, want %d", answers, tt.answers)
+			}
+		})
+	}
+}
@@ -2,16 +2,14 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"os"
 	"os/exec"
-
-	"errors"
+	"strings"
 )
 
-func execCommand(ctx context.Context, command string) error {
-	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+// execCommand runs args without a shell, so arguments are passed as is
+func execCommand(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
@@ -23,17 +21,25 @@ func execCommand(ctx context.Context, command string) error {
 	return nil
 }
 
-func ModifyRoutes(ctx context.Context, su, command string, routes ...string) error {
-	var err error
-	for _, route := range routes {
-		cmdStr := fmt.Sprintf("%s ip route %s %s", su, command, route)
-		log.Printf("  %s", cmdStr)
-		if e := execCommand(ctx, cmdStr); e != nil {
-			if err == nil {
-				err = errors.New("error adding routes:")
-			}
-			err = fmt.Errorf("%w\n  %s %s: %w", err, command, route, e)
+// execArgs runs a command without a shell, prefixed with su (i.e. sudo) when set
+func execArgs(ctx context.Context, su string, args ...string) error {
+	if su != "" {
+		args = append([]string{su}, args...)
+	}
+	return execCommand(ctx, args...)
+}
+
+// quoteArgs quotes args for display and for commands that split a string themselves (rsync --rsh, remote shells)
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`;&|<>()*?[]{}!#~") {
+			quoted[i] = arg
+		} else if !strings.Contains(arg, "'") {
+			quoted[i] = "'" + arg + "'"
+		} else {
+			quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(arg) + `"`
 		}
 	}
-	return err
+	return strings.Join(quoted, " ")
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	forwardRetryInterval = 5 * time.Second
+	forwardAliveInterval = 15 // seconds between ssh keepalives, the tunnel restarts after 3 missed
+)
+
+// forwardState is written for background forwards, for forward list and stop
+type forwardState struct {
+	PID     int
+	Domain  string
+	Specs   []string
+	Config  string
+	Log     string
+	Started time.Time
+}
+
+// ParseForwardSpec turns "local:remote" (or "port", or "local:host:remote") into an ssh -L forward,
+// remote ports are on the domain's localhost by default
+func ParseForwardSpec(spec string) (string, error) {
+	parts := strings.Split(spec, ":")
+	for _, port := range []string{parts[0], parts[len(parts)-1]} {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("forward %q: invalid port %q", spec, port)
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return parts[0] + ":localhost:" + parts[0], nil
+	case 2:
+		return parts[0] + ":localhost:" + parts[1], nil
+	case 3:
+		return spec, nil
+	}
+	return "", fmt.Errorf("forward %q is not local:remote or local:host:remote", spec)
+}
+
+func forwardStateDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lvdev", "forwards"), nil
+}
+
+// processAlive checks for a running process with signal 0
+func processAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
+
+// forwardDomain runs the ssh tunnels for the domain until ctx is done, reconnecting when ssh exits (i.e. the domain
+// restarted) with the domain looked up and its address resolved again
+func (c *Config) forwardDomain(ctx context.Context, specs []string) error {
+	forwards := []string{}
+	for _, spec := range specs {
+		forward, err := ParseForwardSpec(spec)
+		if err != nil {
+			return err
+		}
+		forwards = append(forwards, forward)
+	}
+	if len(forwards) == 0 {
+		return fmt.Errorf("no forwards for domain %q (i.e. forward -n %s 8080:80)", c.Name, c.Name)
+	}
+	for ctx.Err() == nil {
+		if err := c.runForwardTunnel(ctx, forwards); err != nil && ctx.Err() == nil {
+			log.Printf("WARN: forwards to %q: %v, retrying in %v", c.Name, err, forwardRetryInterval)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(forwardRetryInterval):
+		}
+	}
+	return nil
+}
+
+func (c *Config) runForwardTunnel(ctx context.Context, forwards []string) error {
+	dom, err := c.conn.LookupDomainByName(c.Name)
+	if err != nil {
+		return err
+	}
+	if c.dom != nil {
+		c.dom.Free()
+	}
+	c.dom = dom
+	userHost, err := getDomainSSHUserHost(c)
+	if err != nil {
+		return err
+	} else if err := c.ensureHostKeys(); err != nil {
+		return err
+	}
+	options, err := c.domainSSHOptions(c.Name)
+	if err != nil {
+		return err
+	}
+	options = append(options,
+		"-N",
+		"-oExitOnForwardFailure=yes",
+		"-oServerAliveInterval="+strconv.Itoa(forwardAliveInterval),
+		"-oServerAliveCountMax=3",
+	)
+	for _, forward := range forwards {
+		options = append(options, "-L", forward)
+	}
+	sshArgs := getSSHArgs(c, options, userHost, "")
+	if c.Verbose {
+		log.Printf("ssh command:\n  %s", quoteArgs(sshArgs))
+	}
+	log.Printf("forwarding %s to domain %q at %q", strings.Join(forwards, " "), c.Name, userHost)
+	cmd := exec.CommandContext(ctx, sshArgs[0], sshArgs[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// startForward runs forward for the domain as a background process, logging to the state dir
+func startForward(configfile, domName string, specs []string) error {
+	for _, spec := range specs {
+		if _, err := ParseForwardSpec(spec); err != nil {
+			return err
+		}
+	}
+	dir, err := forwardStateDir()
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	statePath := filepath.Join(dir, domName+".json")
+	if state, err := readForwardState(statePath); err == nil && processAlive(state.PID) {
+		log.Printf("forwards to %q already running (pid %d)", domName, state.PID)
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if configfile, err = filepath.Abs(configfile); err != nil {
+		return err
+	}
+	logPath := filepath.Join(dir, domName+".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd := exec.Command(exe, append([]string{"-c", configfile, "-n", domName, "forward"}, specs...)...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// detach from the terminal so the tunnels outlive this process
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	state := forwardState{
+		PID:     cmd.Process.Pid,
+		Domain:  domName,
+		Specs:   specs,
+		Config:  configfile,
+		Log:     logPath,
+		Started: time.Now(),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	} else if err := os.WriteFile(statePath, data, 0600); err != nil {
+		return err
+	}
+	log.Printf("started forwards %s to %q in the background (pid %d, log %s)", strings.Join(specs, " "), domName, state.PID, logPath)
+	return cmd.Process.Release()
+}
+
+func readForwardState(path string) (*forwardState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &forwardState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// listForwardStates reads the background forwards, removing the state of stopped ones
+func listForwardStates() ([]*forwardState, error) {
+	dir, err := forwardStateDir()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	states := []*forwardState{}
+	for _, path := range paths {
+		state, err := readForwardState(path)
+		if err != nil {
+			return nil, err
+		} else if !processAlive(state.PID) {
+			os.Remove(path)
+			continue
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Domain < states[j].Domain
+	})
+	return states, nil
+}
+
+func reportForwards(w io.Writer) error {
+	states, err := listForwardStates()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tPID\tFORWARDS\tSTARTED\tLOG")
+	for _, state := range states {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", state.Domain, state.PID, strings.Join(state.Specs, " "), state.Started.Format(time.DateTime), state.Log)
+	}
+	return tw.Flush()
+}
+
+// stopForwards stops the background forwards of the domain, or all of them without a domain name
+func stopForwards(domName string) error {
+	states, err := listForwardStates()
+	if err != nil {
+		return err
+	}
+	dir, err := forwardStateDir()
+	if err != nil {
+		return err
+	}
+	stopped := 0
+	for _, state := range states {
+		if domName != "" && state.Domain != domName {
+			continue
+		}
+		log.Printf("stopping forwards to %q (pid %d)", state.Domain, state.PID)
+		if err := syscall.Kill(state.PID, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+		os.Remove(filepath.Join(dir, state.Domain+".json"))
+		stopped++
+	}
+	if stopped == 0 {
+		log.Printf("no background forwards to stop")
+	}
+	return nil
+}
+
+// up starts the background Forwards of the config, only the domain's when a name is given
+func (c *Config) up(configfile string) error {
+	if len(c.Forwards) == 0 {
+		return errors.New("no Forwards in config")
+	}
+	domNames := []string{}
+	for domName := range c.Forwards {
+		if c.Name == "" || c.Name == domName {
+			domNames = append(domNames, domName)
+		}
+	}
+	if len(domNames) == 0 {
+		return fmt.Errorf("no Forwards for domain %q in config", c.Name)
+	}
+	sort.Strings(domNames)
+	for _, domName := range domNames {
+		if err := startForward(configfile, domName, c.Forwards[domName]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultKnownHostsFile = "~/.ssh/lvdev_known_hosts"
+
+// knownHostsMu serializes known_hosts updates of domains handled in parallel (run)
+var knownHostsMu sync.Mutex
+
+func (c *Config) GetKnownHostsFile() (string, error) {
+	path := c.KnownHostsFile
+	if path == "" {
+		path = defaultKnownHostsFile
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(path, "~/", home+string(os.PathSeparator), 1), nil
+}
+
+// domainSSHOptions check the domain's host key strictly against the pinned keys, by domain name so address changes
+// don't matter, and jump through the hypervisor with ProxyJump
+func (c *Config) domainSSHOptions(domName string) ([]string, error) {
+	path, err := c.GetKnownHostsFile()
+	if err != nil {
+		return nil, err
+	}
+	options := []string{
+		"-oStrictHostKeyChecking=yes",
+		"-oUserKnownHostsFile=" + path,
+		"-oHostKeyAlias=" + domName,
+	}
+	if c.ProxyJump {
+		jump, err := c.GetProxyJump()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, "-J", jump)
+	}
+	return options, nil
+}
+
+// knownHostsHasName checks whether a known_hosts line is for one of names
+func knownHostsHasName(line string, names map[string]bool) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+		return false
+	}
+	for _, host := range strings.Split(fields[0], ",") {
+		if names[host] {
+			return true
+		}
+	}
+	return false
+}
+
+// updateKnownHosts replaces the entries for names in the lvdev known_hosts file with keys (none to only delete them)
+func (c *Config) updateKnownHosts(names []string, keys []string) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	path, err := c.GetKnownHostsFile()
+	if err != nil {
+		return err
+	}
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	drop := map[string]bool{}
+	for _, name := range names {
+		drop[name] = true
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(current), "\n") {
+		if line != "" && !knownHostsHasName(line, drop) {
+			lines = append(lines, line)
+		}
+	}
+	for _, key := range keys {
+		lines = append(lines, strings.Join(names, ",")+" "+key)
+	}
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	if len(lines) == 0 {
+		data = []byte{}
+	}
+	if current != nil {
+		return writeFileAtomic(context.Background(), "", path, data)
+	} else if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// hasKnownHost checks the lvdev known_hosts file for keys of the domain
+func (c *Config) hasKnownHost() bool {
+	path, err := c.GetKnownHostsFile()
+	if err != nil {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if knownHostsHasName(line, map[string]bool{c.Name: true}) {
+			return true
+		}
+	}
+	return false
+}
+
+// initHostKeys pins the domain's ssh host keys, read through the guest agent, under its name and addresses
+func (c *Config) initHostKeys() error {
+	log.Printf("pinning ssh host keys for %q", c.Name)
+	keys := []string{}
+	// sshd may still be generating its keys on first boot
+	for i := 0; i < c.WaitSecs/waitInterval+1; i += 1 {
+		status, err := ExecuteGuestCommand(c.dom, waitInterval, "sh", "-c", "cat /etc/ssh/ssh_host_*_key.pub")
+		if err == nil {
+			for _, line := range strings.Split(string(status.OutData), "\n") {
+				// "type base64 comment", the comment is dropped
+				if fields := strings.Fields(line); len(fields) >= 2 {
+					keys = append(keys, fields[0]+" "+fields[1])
+				}
+			}
+		}
+		if len(keys) > 0 {
+			break
+		}
+		log.Printf("waiting for domain %q ssh host keys... (%v)", c.Name, err)
+		time.Sleep(time.Duration(waitInterval) * time.Second)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no ssh host keys found in /etc/ssh of %q", c.Name)
+	}
+	names := []string{c.Name}
+	if addrs, err := c.getDomainIPAddresses(c.dom); err == nil {
+		for _, addr := range addrs {
+			names = append(names, addr.Addr)
+		}
+	} else {
+		log.Printf("WARN: pinning ssh host keys for %q without addresses: %v", c.Name, err)
+	}
+	return c.updateKnownHosts(names, keys)
+}
+
+// delHostKeys removes the domain's pinned ssh host keys
+func (c *Config) delHostKeys() error {
+	names := []string{c.Name}
+	if c.dom != nil {
+		if addrs, err := c.getDomainIPAddresses(c.dom); err == nil {
+			for _, addr := range addrs {
+				names = append(names, addr.Addr)
+			}
+		}
+	}
+	return c.updateKnownHosts(names, nil)
+}
+
+// ensureHostKeys pins the host keys of domains created before keys were pinned
+func (c *Config) ensureHostKeys() error {
+	if c.dom == nil || c.hasKnownHost() {
+		return nil
+	}
+	return c.initHostKeys()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+const (
+	hostsFile = "/etc/hosts"
+)
+
+type (
+	hostsEntry struct {
+		IP    string
+		Names []string
+	}
+	domainAddresses struct {
+		Name  string
+		Addrs []string
+	}
+)
+
+// listDomainAddresses collects the addresses of every domain, running domains from the guest agent (or leases)
+// and stopped ones from their ip reservation in Net
+func (c *Config) listDomainAddresses() ([]domainAddresses, error) {
+	doms, err := c.conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_PERSISTENT)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, dom := range doms {
+			dom.Free()
+		}
+	}()
+	reserved := map[string][]string{}
+	if c.net != nil {
+		netDef, err := GetNetworkDef(c.net)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range netDef.IPs {
+			if ip.DHCP == nil {
+				continue
+			}
+			for _, host := range ip.DHCP.Hosts {
+				if host.Name != "" && host.IP != "" {
+					reserved[host.Name] = append(reserved[host.Name], host.IP)
+				}
+			}
+		}
+	}
+	domains := []domainAddresses{}
+	for _, dom := range doms {
+		domName, err := dom.GetName()
+		if err != nil {
+			return nil, err
+		}
+		ips := reserved[domName]
+		if active, err := dom.IsActive(); err == nil && active {
+			if addrs, err := c.getDomainIPAddresses(&dom); err == nil {
+				ips = []string{}
+				for _, addr := range addrs {
+					ips = append(ips, addr.Addr)
+				}
+			} else if len(ips) == 0 {
+				log.Printf("WARN: no addresses for domain %q: %v", domName, err)
+			}
+		}
+		if len(ips) > 0 {
+			domains = append(domains, domainAddresses{Name: domName, Addrs: ips})
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Name < domains[j].Name
+	})
+	return domains, nil
+}
+
+// listHostsEntries maps every domain address to the domain name and its NetDNSHostnames aliases
+func (c *Config) listHostsEntries() ([]hostsEntry, error) {
+	domains, err := c.listDomainAddresses()
+	if err != nil {
+		return nil, err
+	}
+	entries := []hostsEntry{}
+	for _, domain := range domains {
+		for _, ip := range domain.Addrs {
+			entries = append(entries, hostsEntry{IP: ip, Names: append([]string{domain.Name}, c.NetDNSHostnames[domain.Name]...)})
+		}
+	}
+	return entries, nil
+}
+
+// managedBlockConnect names the libvirt connection in managed block markers, each connection has its own block
+func (c *Config) managedBlockConnect() string {
+	if c.Connect == "" {
+		// the default connection, libvirt picks the local hypervisor
+		return "default"
+	}
+	return c.Connect
+}
+
+// hasManagedBlock checks data for the begin line of a managed block
+func hasManagedBlock(data []byte, begin string) bool {
+	begin = strings.TrimSpace(begin)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == begin {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceManagedBlock replaces (or appends) the block delimited by the begin and end lines, an empty body removes it
+func replaceManagedBlock(data []byte, begin, end, body string) []byte {
+	out := &bytes.Buffer{}
+	inBlock := false
+	// lines are compared trimmed, so are the markers
+	begin, end = strings.TrimSpace(begin), strings.TrimSpace(end)
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		switch strings.TrimSpace(line) {
+		case begin:
+			inBlock = true
+		case end:
+			inBlock = false
+		default:
+			if !inBlock && line != "" {
+				out.WriteString(line)
+			}
+		}
+	}
+	if body == "" {
+		return out.Bytes()
+	}
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteString("\n")
+	}
+	fmt.Fprintln(out, begin)
+	out.WriteString(body)
+	fmt.Fprintln(out, end)
+	return out.Bytes()
+}
+
+// hostsBlock delimits the entries of one libvirt connection, the blocks of other hypervisors are left alone
+func (c *Config) hostsBlock() (begin, end string) {
+	connect := c.managedBlockConnect()
+	return "# BEGIN lvdev managed block for " + connect + ", changes are overwritten by lvdev hosts sync",
+		"# END lvdev managed block for " + connect
+}
+
+// ReplaceHostsBlock replaces (or appends) the managed block delimited by begin and end in a hosts file, no entries
+// remove it
+func ReplaceHostsBlock(hosts []byte, begin, end string, entries []hostsEntry) []byte {
+	body := &strings.Builder{}
+	for _, entry := range entries {
+		fmt.Fprintf(body, "%s\t%s\n", entry.IP, strings.Join(entry.Names, " "))
+	}
+	return replaceManagedBlock(hosts, begin, end, body.String())
+}
+
+// hasHostsBlock checks whether the hosts file already has the connection's managed block, domain changes keep it current
+func (c *Config) hasHostsBlock() bool {
+	hosts, err := os.ReadFile(hostsFile)
+	begin, _ := c.hostsBlock()
+	return err == nil && hasManagedBlock(hosts, begin)
+}
+
+// syncHosts writes every domain's addresses and NetDNSHostnames aliases to the managed block in /etc/hosts
+func (c *Config) syncHosts(ctx context.Context) error {
+	log.Printf("checking hosts entries in %s...", hostsFile)
+	entries, err := c.listHostsEntries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := netip.ParseAddr(entry.IP); err != nil {
+			return fmt.Errorf("hosts entry %q: %w", entry.Names[0], err)
+		}
+	}
+	path, err := filepath.EvalSymlinks(hostsFile)
+	if err != nil {
+		return err
+	}
+	hosts, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	begin, end := c.hostsBlock()
+	updated := ReplaceHostsBlock(hosts, begin, end, entries)
+	if bytes.Equal(hosts, updated) {
+		log.Printf("hosts entries up to date (%d entries)", len(entries))
+		return nil
+	}
+	log.Printf("updating hosts entries (%d entries)", len(entries))
+	return writeFileAtomic(ctx, c.Sudo, path, updated)
+}
+
+// writeFileAtomic replaces path with a renamed temp file, through su (i.e. sudo) when not writable
+func writeFileAtomic(ctx context.Context, su, path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".lvdev-*"); err == nil {
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		} else if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			tmp.Close()
+			return err
+		} else if err := tmp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), path)
+	} else if su == "" {
+		return fmt.Errorf("%w (see config Sudo)", err)
+	}
+	// stage the file next to path as root, so the final mv is a rename on the same filesystem
+	tmp, err := os.CreateTemp("", "lvdev-hosts-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Close(); err != nil {
+		return err
+	}
+	staged := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".lvdev")
+	mode := fmt.Sprintf("%04o", info.Mode().Perm())
+	if err := execArgs(ctx, su, "install", "-m", mode, tmp.Name(), staged); err != nil {
+		return err
+	}
+	return execArgs(ctx, su, "mv", "-f", staged, path)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// each connection's block is replaced on its own, the other hypervisor's entries stay
+func TestHostsBlockPerConnection(t *testing.T) {
+	local := &Config{}
+	remote := &Config{Connect: "qemu+ssh://root@hv2/system"}
+	hosts := []byte("127.0.0.1\tlocalhost\n")
+
+	localBegin, localEnd := local.hostsBlock()
+	remoteBegin, remoteEnd := remote.hostsBlock()
+	hosts = ReplaceHostsBlock(hosts, localBegin, localEnd, []hostsEntry{{IP: "192.168.125.10", Names: []string{"web"}}})
+	hosts = ReplaceHostsBlock(hosts, remoteBegin, remoteEnd, []hostsEntry{{IP: "10.10.0.10", Names: []string{"db", "db.lan"}}})
+	if !hasManagedBlock(hosts, localBegin) || !hasManagedBlock(hosts, remoteBegin) {
+		t.Fatalf("blocks not found:\n%s", hosts)
+	}
+	if otherBegin, _ := (&Config{Connect: "qemu+ssh://hv3/system"}).hostsBlock(); hasManagedBlock(hosts, otherBegin) {
+		t.Errorf("block of another connection found:\n%s", hosts)
+	}
+
+	updated := ReplaceHostsBlock(hosts, localBegin, localEnd, []hostsEntry{{IP: "192.168.125.11", Names: []string{"web"}}})
+	if !strings.Contains(string(updated), "10.10.0.10\tdb db.lan\n") {
+		t.Errorf("syncing one connection dropped the other's entries:\n%s", updated)
+	} else if strings.Contains(string(updated), "192.168.125.10") {
+		t.Errorf("old entry kept:\n%s", updated)
+	}
+	if again := ReplaceHostsBlock(updated, localBegin, localEnd, []hostsEntry{{IP: "192.168.125.11", Names: []string{"web"}}}); !bytes.Equal(again, updated) {
+		t.Errorf("second sync changed the file:\n%s\nwant:\n%s", again, updated)
+	}
+
+	removed := ReplaceHostsBlock(updated, localBegin, localEnd, nil)
+	if hasManagedBlock(removed, localBegin) || !hasManagedBlock(removed, remoteBegin) {
+		t.Errorf("removing the local block:\n%s", removed)
+	} else if !strings.HasPrefix(string(removed), "127.0.0.1\tlocalhost\n") {
+		t.Errorf("lines outside the blocks changed:\n%s", removed)
+	}
+}
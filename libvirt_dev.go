@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,30 +20,60 @@ import (
 
 type (
 	Config struct {
-		Name            string              // libvirt domain name (VM name)
-		Template        string              // libvirt domain XML filename to use as a template
-		Memory          uint                // memory to allocate
-		VCPU            uint                // number of vCPUs to allocate
-		BaseDisk        string              // local filename
-		Connect         string              // libvirt connect url, i.e. qemu+ssh://host/system
-		Net             string              // libvirt network name
-		NetBridge       string              // interface name, i.e. virbr*
-		NetRange        string              // private cidr
-		NetDNS          string              // nameserver IP
-		NetDNSHostnames map[string][]string // libvirt network dns host aliases
-		NetMode         string              //libvirt network forward "mode" (i.e. open,bridge are supported)
-		Pool            string              // libvirt pool name
-		PoolPath        string              // remote hypervisor directory
-		AuthorizedKeys  string              // filename containing ssh public keys
-		Hypervisor      string              // IP address
-		Username        string              // ssh username configure with public keys
-		Routes          []string            // custom local routes to libvirt network
-		Sudo            string              // command to as root command i.e. sudo, doas, etc
-		WaitSecs        int                 // number of seconds to wait for instance to boot
-		RemoteDir       string              // remote rsync dir
-		RsyncOptions    []string            // custom rsync options
-		DomainIfname    string              // domain interface name (i.e. eth0)
-		Verbose         bool
+		Name               string              // libvirt domain name (VM name)
+		Template           string              // libvirt domain XML filename to use as a template
+		Memory             uint                // memory to allocate
+		VCPU               uint                // number of vCPUs to allocate
+		BaseDisk           string              // local filename
+		Connect            string              // libvirt connect url, i.e. qemu+ssh://host/system
+		Net                string              // libvirt network name
+		NetBridge          string              // interface name, i.e. virbr*, or "auto"
+		NetRange           string              // private cidr, or "auto" for a free /24 in NetSupernet
+		NetSupernet        string              // cidr to allocate "auto" NetRange from (default 10.100.0.0/16)
+		NetRange6          string              // private ipv6 cidr (i.e. fd00:1::/64)
+		NetDHCP6           bool                // serve DHCPv6 in NetRange6 instead of router advertisements only
+		NetDNS             string              // nameserver IP (forwarder for all queries)
+		NetDNSForwarders   []DNSForwarder      // more forwarders, optionally per domain
+		NetDNSSRV          []DNSSRV            // network dns SRV records
+		NetDNSTXT          map[string]string   // network dns TXT records by name
+		NetDomain          string              // network dns domain, i.e. lab.lan
+		NetDomainLocalOnly bool                // answer NetDomain from the network only, never forward it
+		NetDNSHostnames    map[string][]string // libvirt network dns host aliases
+		DNSSuffix          string              // domain suffix served by "dns serve" (default lvdev)
+		DNSListen          string              // "dns serve" udp and tcp address (default 127.0.0.1:53535)
+		NetMode            string              // libvirt network forward mode (nat (default), route, open, isolated or bridge)
+		PortForwards       map[string]string   // hypervisor port[/udp] to domain:port forwards (nat mode)
+		Forwards           map[string][]string // workstation to domain port forwards (local:remote) by domain name, for "lvdev up"
+		Labels             map[string]string   // domain labels (domain metadata) to select domains for "run -l"
+		IP                 string              // fixed domain IP reserved in the network DHCP (default derived from the domain MAC)
+		Pool               string              // libvirt pool name
+		PoolPath           string              // remote hypervisor directory
+		PoolType           string              // libvirt pool type (dir, fs, netfs, logical, zfs)
+		PoolSourceHost     string              // netfs server hostname
+		PoolSourceDir      string              // netfs server export path
+		PoolSourceDevices  []string            // fs block device, logical physical volumes or zfs vdevs
+		PoolSourceName     string              // logical volume group or zfs pool name (default Pool)
+		PoolSourceFormat   string              // pool source format (i.e. ext4, nfs, lvm2)
+		DiskFormat         string              // volume format (default qcow2, raw for logical,zfs pools)
+		PoolReserve        uint                // percent of pool capacity to keep free when creating volumes
+		AuthorizedKeys     string              // filename containing ssh public keys
+		KnownHostsFile     string              // lvdev managed ssh known_hosts with the pinned domain host keys (default ~/.ssh/lvdev_known_hosts)
+		SSHConfigFile      string              // ssh config include written by ssh-config (default ~/.ssh/lvdev.conf)
+		Hypervisor         string              // IP address
+		Hypervisor6        string              // hypervisor IPv6 address (for IPv6 routes)
+		ProxyJump          bool                // reach domains through the hypervisor with ssh -J instead of local routes
+		NativeSSH          bool                // in-process ssh client for -syncconf, run and hypervisor commands instead of the ssh binary
+		PreferIPv6         bool                // connect to domains with IPv6 (ssh, rsync)
+		Username           string              // ssh username configure with public keys
+		Routes             []string            // custom local routes to libvirt network
+		Sudo               string              // command to as root command i.e. sudo, doas, etc
+		WaitSecs           int                 // number of seconds to wait for instance to boot
+		RemoteDir          string              // remote rsync dir
+		RsyncOptions       []string            // custom rsync options
+		DomainIfname       string              // domain interface name (i.e. eth0)
+		Networks           []DomainNetwork     // networks the domain is attached to (default Net)
+		Shares             []Share             // hypervisor directories shared into the domain
+		Verbose            bool
 
 		conn    *libvirt.Connect
 		pool    *libvirt.StoragePool
@@ -121,7 +150,14 @@ func (c *Config) GetRoutes() []string {
 		c.Routes = []string{}
 	}
 	routes := c.Routes
-	prefix, err := GetNetworkPrefix(c.net)
+	if !c.GetPrimaryNetwork().IsLibvirtNetwork() {
+		// the domain is on the hypervisor's LAN, no route needed
+		return routes
+	} else if c.ProxyJump {
+		// ssh and rsync jump through the hypervisor
+		return routes
+	}
+	prefixes, err := GetNetworkPrefixes(c.net)
 	if err != nil {
 		log.Printf("WARN: net prefix error: %v", err)
 		return routes
@@ -131,10 +167,28 @@ func (c *Config) GetRoutes() []string {
 		log.Printf("WARN: hypervisor host error: %v", err)
 		return routes
 	}
-	routes = append(routes, prefix.String()+" via "+host)
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is4() {
+			routes = append(routes, prefix.Masked().String()+" via "+host)
+		} else if host6 := c.GetHypervisorHost6(host); host6 != "" {
+			routes = append(routes, prefix.Masked().String()+" via "+host6)
+		} else {
+			log.Printf("WARN: no ipv6 hypervisor address for route to %s (see Hypervisor6)", prefix)
+		}
+	}
 	return routes
 }
 
+// GetHypervisorHost6 is the IPv6 hypervisor address for IPv6 routes
+func (c *Config) GetHypervisorHost6(host string) string {
+	if c.Hypervisor6 != "" {
+		return c.Hypervisor6
+	} else if ip, err := netip.ParseAddr(host); err == nil && ip.Is6() {
+		return host
+	}
+	return ""
+}
+
 func (c *Config) GetUsername() string {
 	if c.Username == "" {
 		return "root"
@@ -263,17 +317,10 @@ func (c *Config) loadDomainVol() error {
 
 func (c *Config) initPool() error {
 	if c.pool == nil {
-		log.Printf("creating pool %q", c.Pool)
-		pool := &libvirtxml.StoragePool{
-			Type:   "dir",
-			Name:   c.Pool,
-			Source: &libvirtxml.StoragePoolSource{},
-			Target: &libvirtxml.StoragePoolTarget{
-				Path: c.PoolPath,
-				Permissions: &libvirtxml.StoragePoolTargetPermissions{
-					Mode: "0755",
-				},
-			},
+		log.Printf("creating %s pool %q", c.GetPoolType(), c.Pool)
+		pool, err := c.StoragePoolXML()
+		if err != nil {
+			return err
 		}
 		poolXML, err := pool.Marshal()
 		if err != nil {
@@ -284,7 +331,18 @@ func (c *Config) initPool() error {
 		}
 		if c.pool, err = c.conn.StoragePoolDefineXML(poolXML, 0); err != nil {
 			return err
-		} else if err := c.pool.Create(libvirt.STORAGE_POOL_CREATE_WITH_BUILD); err != nil {
+		}
+		if c.IsFilePool() {
+			if err := c.pool.Build(libvirt.STORAGE_POOL_BUILD_NEW); err != nil {
+				return err
+			}
+		} else if len(c.PoolSourceDevices) > 0 {
+			// never format devices that already have data (i.e. an existing volume group)
+			if err := c.pool.Build(libvirt.STORAGE_POOL_BUILD_NO_OVERWRITE); err != nil {
+				return err
+			}
+		}
+		if err := c.pool.Create(libvirt.STORAGE_POOL_CREATE_NORMAL); err != nil {
 			return err
 		} else if err := c.pool.SetAutostart(true); err != nil {
 			return err
@@ -315,14 +373,13 @@ func (c *Config) initBaseVol() error {
 		if err != nil {
 			return err
 		}
+		if err := c.checkPoolSpace(fmt.Sprintf("base volume %q", base), uint64(stat.Size())); err != nil {
+			return err
+		}
 		baseVol := &libvirtxml.StorageVolume{
 			Name:     base,
 			Capacity: &libvirtxml.StorageVolumeSize{Value: uint64(stat.Size()), Unit: "bytes"},
-			Target: &libvirtxml.StorageVolumeTarget{
-				Format: &libvirtxml.StorageVolumeTargetFormat{
-					Type: "qcow2",
-				},
-			},
+			Target:   c.StorageVolumeTarget(),
 		}
 		baseVolXML, err := baseVol.Marshal()
 		if err != nil {
@@ -375,78 +432,78 @@ func (c *Config) loadNetwork() error {
 		if !IsErrorCode(err, libvirt.ERR_NO_NETWORK) {
 			return err
 		}
+		return nil
 	}
-	return nil
+	return c.resolveAutoNetwork(c.net)
 }
 
 func (c *Config) initNetwork() error {
-	if c.net != nil {
-		return nil
+	if c.net == nil && c.usesNet() {
+		if err := c.allocNetwork(c); err != nil {
+			return err
+		}
+		log.Printf("creating %s net %q", c.GetNetMode(), c.Net)
+		var err error
+		if c.net, err = c.defineNetwork(c); err != nil {
+			return err
+		}
+		log.Printf("created net %q", c.Net)
 	}
-	log.Printf("creating net %q", c.Net)
-	prefix, err := netip.ParsePrefix(c.NetRange)
-	if err != nil {
-		return err
+	for _, n := range c.GetNetworks() {
+		if !n.IsLibvirtNetwork() {
+			log.Printf("skipping %s interface %q, not a libvirt network", n.GetType(), n.Name)
+			continue
+		} else if n.Name == c.Net {
+			continue
+		}
+		log.Printf("checking net %q...", n.Name)
+		if net, err := c.conn.LookupNetworkByName(n.Name); err == nil {
+			net.Free()
+			continue
+		} else if !IsErrorCode(err, libvirt.ERR_NO_NETWORK) {
+			return err
+		} else if n.Range == "" && n.Mode != netModeBridge {
+			return fmt.Errorf("net %q does not exist and has no Range to create it", n.Name)
+		}
+		nc := c.networkConfig(n)
+		if err := c.allocNetwork(nc); err != nil {
+			return err
+		}
+		log.Printf("creating %s net %q", nc.GetNetMode(), n.Name)
+		net, err := c.defineNetwork(nc)
+		if err != nil {
+			return err
+		}
+		net.Free()
+		log.Printf("created net %q", n.Name)
 	}
-	net := &libvirtxml.Network{
-		Name: c.Net,
-		DNS: &libvirtxml.NetworkDNS{
-			ForwardPlainNames: "no",
-			Forwarders: []libvirtxml.NetworkDNSForwarder{
-				{Addr: c.NetDNS},
-			},
-		},
-		Forward: &libvirtxml.NetworkForward{
-			Mode: c.NetMode,
-		},
-		Bridge: &libvirtxml.NetworkBridge{
-			Name: c.NetBridge,
-		},
-	}
-	if c.NetMode == "open" {
-		net.IPs = []libvirtxml.NetworkIP{
-			{
-				Address:  prefix.Addr().Next().String(),
-				Netmask:  MaskAddr(prefix).String(),
-				LocalPtr: "yes",
-				DHCP: &libvirtxml.NetworkDHCP{
-					Ranges: []libvirtxml.NetworkDHCPRange{
-						{
-							Start: prefix.Addr().Next().Next().String(),
-							End:   BroadcastAddr(prefix).Prev().String(),
-							Lease: &libvirtxml.NetworkDHCPLease{
-								Expiry: 1,
-								Unit:   "hours",
-							},
-						},
-					},
-				},
-			},
-		}
-		//DnsmasqOptions: &libvirtxml.NetworkDnsmasqOptions{
-		//	Option: []libvirtxml.NetworkDnsmasqOption{
-		//		{Value: "address=/"},
-		//	},
-		//},
-	} else if c.NetMode != "bridge" {
-		log.Printf("WARN: net mode=%q may not be supported", c.NetMode)
+	return nil
+}
+
+// defineNetwork defines and starts the network of nc's Net* settings
+func (c *Config) defineNetwork(nc *Config) (*libvirt.Network, error) {
+	net, err := nc.NetworkXML()
+	if err != nil {
+		return nil, err
 	}
 	netXML, err := net.Marshal()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if c.Verbose {
 		fmt.Println(netXML)
 	}
-	if c.net, err = c.conn.NetworkDefineXML(netXML); err != nil {
-		return err
-	} else if err := c.net.SetAutostart(true); err != nil {
-		return err
-	} else if err := c.net.Create(); err != nil {
-		return err
-	}
-	log.Printf("created net %q", c.Net)
-	return nil
+	n, err := c.conn.NetworkDefineXML(netXML)
+	if err != nil {
+		return nil, err
+	} else if err := n.SetAutostart(true); err != nil {
+		n.Free()
+		return nil, err
+	} else if err := n.Create(); err != nil {
+		n.Free()
+		return nil, err
+	}
+	return n, nil
 }
 
 func (c *Config) initAuthorizedKeys() error {
@@ -471,34 +528,19 @@ func (c *Config) initAuthorizedKeys() error {
 
 func (c *Config) initHostname() error {
 	log.Printf("setting hostname for %q", c.Name)
-	handle, oErr := ExecuteQemuAgentCommand(c.dom,
-		"guest-file-open", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
-		"path", "/etc/hostname",
-		"mode", "w")
-	if oErr != nil {
-		log.Printf("setting hostname failed to open /etc/hostname")
-		return oErr
-	}
-	_, err := ExecuteQemuAgentCommand(c.dom,
-		"guest-file-write", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
-		"handle", handle,
-		"buf-b64", base64.StdEncoding.EncodeToString([]byte(c.Name)),
-		"count", len(c.Name))
-	_, cErr := ExecuteQemuAgentCommand(c.dom,
-		"guest-file-close", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
-		"handle", handle)
-	if cErr != nil {
-		log.Printf("setting hostname failed to close /etc/hostname")
+	if err := WriteGuestFile(c.dom, "/etc/hostname", "w", []byte(c.Name)); err != nil {
+		log.Printf("setting hostname failed: %v", err)
+		return err
 	}
 	//_, _ = ExecuteQemuAgentCommand(c.dom, "guest-execute", 1,
 	//	"path", "/bin/hostname", "arg", []string{"-F", "/etc/hostname"})
-	return err
+	return nil
 }
 
 func (c *Config) initRoutes() error {
 	routes := c.GetRoutes()
 	log.Printf("add routes %v...", routes)
-	if err := ModifyRoutes(context.Background(), c.Sudo, "add", routes...); err != nil {
+	if _, err := ModifyRoutes(context.Background(), c.Sudo, "add", routes...); err != nil {
 		return err
 	}
 	return nil
@@ -507,17 +549,38 @@ func (c *Config) initRoutes() error {
 func (c *Config) delRoutes() error {
 	routes := c.GetRoutes()
 	log.Printf("del routes %v...", routes)
-	if err := ModifyRoutes(context.Background(), c.Sudo, "del", routes...); err != nil {
+	if _, err := ModifyRoutes(context.Background(), c.Sudo, "del", routes...); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (c *Config) delDomain() error {
+	if err := c.delDHCPHosts(); err != nil {
+		log.Printf("WARN: ip reservation error: %v", err)
+	}
+	if err := c.delPortForwards(context.Background()); err != nil {
+		log.Printf("WARN: port forwards error: %v", err)
+	}
+	if err := c.delHostKeys(); err != nil {
+		log.Printf("WARN: ssh host keys error: %v", err)
+	}
 	if err := deleteStorageVol(c.Disk(), c.vol); err != nil {
 		return err
 	}
-	return deleteLibvirtEntity("domain", c.Name, c.dom, libvirt.ERR_NO_DOMAIN, libvirt.ERR_OPERATION_INVALID)
+	if err := deleteLibvirtEntity("domain", c.Name, c.dom, libvirt.ERR_NO_DOMAIN, libvirt.ERR_OPERATION_INVALID); err != nil {
+		return err
+	} else if c.hasHostsBlock() {
+		if err := c.syncHosts(context.Background()); err != nil {
+			log.Printf("WARN: hosts sync error: %v", err)
+		}
+	}
+	if c.hasSSHConfigFile() {
+		if err := c.writeSSHConfig(); err != nil {
+			log.Printf("WARN: ssh config error: %v", err)
+		}
+	}
+	return nil
 }
 
 func (c *Config) delPoolVols() error {
@@ -565,15 +628,19 @@ func (c *Config) initDomainVol() error {
 	if err != nil {
 		return err
 	}
+	required := info.Allocation
+	if !c.IsFilePool() {
+		// block based volumes are fully allocated
+		required = info.Capacity
+	}
+	if err := c.checkPoolSpace(fmt.Sprintf("domain volume %q", c.Disk()), required); err != nil {
+		return err
+	}
 	vol := &libvirtxml.StorageVolume{
 		Name:       c.Disk(),
 		Capacity:   &libvirtxml.StorageVolumeSize{Value: info.Capacity, Unit: "bytes"},
 		Allocation: &libvirtxml.StorageVolumeSize{Value: info.Allocation, Unit: "bytes"},
-		Target: &libvirtxml.StorageVolumeTarget{
-			Format: &libvirtxml.StorageVolumeTargetFormat{
-				Type: "qcow2",
-			},
-		},
+		Target:     c.StorageVolumeTarget(),
 	}
 	volXML, err := vol.Marshal()
 	if err != nil {
@@ -596,11 +663,21 @@ func (c *Config) initDomain() error {
 	}
 	if c.dom == nil {
 		log.Printf("creating domain %q", c.Name)
+		for _, share := range c.Shares {
+			if err := share.Validate(); err != nil {
+				return err
+			}
+		}
+		for _, n := range c.GetNetworks() {
+			if err := n.Validate(); err != nil {
+				return err
+			}
+		}
 		dom, err := ReadDomainXML(c.Template)
 		if err != nil {
 			return err
 		}
-		ConfigureDomainXML(dom, c.Name, c.VCPU, c.Memory, filepath.Join(c.PoolPath, c.Disk()), c.Net, c.NetBridge)
+		ConfigureDomainXML(dom, c.Name, c.VCPU, c.Memory, c.Pool, c.Disk(), c.GetDiskFormat(), c.GetNetworks(), c.Shares)
 		domXML, err := dom.Marshal()
 		if err != nil {
 			return err
@@ -617,6 +694,15 @@ func (c *Config) initDomain() error {
 		}
 		log.Printf("created domain %q", c.Name)
 	}
+	if err := c.initLabels(); err != nil {
+		return err
+	}
+	if err := c.initRsyncMetadata(); err != nil {
+		return err
+	}
+	if err := c.initDHCPHosts(); err != nil {
+		return err
+	}
 	if state, _, err := c.dom.GetState(); err != nil {
 		return err
 	} else if state != libvirt.DOMAIN_RUNNING {
@@ -630,24 +716,45 @@ func (c *Config) initDomain() error {
 		return err
 	} else if err := c.initHostname(); err != nil {
 		return err
-	} else if err := c.syncDomainNamesToNetworkDNS(); err != nil {
+	} else if err := c.initShares(); err != nil {
 		return err
 	}
+	// ensureHostKeys tries again before the first ssh, keys of an earlier domain by that name must not stay pinned
+	if err := c.initHostKeys(); err != nil {
+		log.Printf("WARN: ssh host keys error: %v", err)
+		if err := c.delHostKeys(); err != nil {
+			log.Printf("WARN: failed to remove old ssh host keys: %v", err)
+		}
+	}
+	if c.GetPrimaryNetwork().IsLibvirtNetwork() {
+		if err := c.syncDomainNamesToNetworkDNS(); err != nil {
+			return err
+		}
+	}
+	if err := c.initPortForwards(context.Background()); err != nil {
+		return err
+	} else if c.hasHostsBlock() {
+		if err := c.syncHosts(context.Background()); err != nil {
+			log.Printf("WARN: hosts sync error: %v", err)
+		}
+	}
+	if c.hasSSHConfigFile() {
+		if err := c.writeSSHConfig(); err != nil {
+			log.Printf("WARN: ssh config error: %v", err)
+		}
+	}
 	return nil
 }
 
-func (c *Config) restartAllDomains() error {
+func (c *Config) restartAllDomains(yes bool) error {
 	doms, err := c.conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_PERSISTENT | libvirt.CONNECT_LIST_DOMAINS_RUNNING)
 	if err != nil {
 		return err
 	}
-	log.Printf("restarting network %q...", c.Net)
-	if err := c.net.Destroy(); err != nil {
-		return err
-	} else if err := c.net.Create(); err != nil {
+	// the network is only restarted for changes that can't be applied live
+	if _, err := c.applyNetwork(yes); err != nil {
 		return err
 	}
-	log.Printf("restarted network %q", c.Net)
 	for _, dom := range doms {
 		domName, _ := dom.GetName()
 		log.Printf("restarting domain %q...", domName)
@@ -18,7 +18,7 @@ func ReadDomainXML(filename string) (*libvirtxml.Domain, error) {
 	return dom, nil
 }
 
-func ConfigureDomainXML(dom *libvirtxml.Domain, name string, vcpu, memoryMiB uint, diskPoolVolAbsPath, netName, netBridgeIfname string) {
+func ConfigureDomainXML(dom *libvirtxml.Domain, name string, vcpu, memoryMiB uint, poolName, volName, diskFormat string, networks []DomainNetwork, shares []Share) {
 	dom.Type = "kvm"
 	dom.Name = name
 	dom.VCPU = &libvirtxml.DomainVCPU{
@@ -29,28 +29,45 @@ func ConfigureDomainXML(dom *libvirtxml.Domain, name string, vcpu, memoryMiB uin
 		Value: memoryMiB,
 		Unit:  "MiB",
 	}
-	dom.Devices.Interfaces = []libvirtxml.DomainInterface{
-		{
-			Source: &libvirtxml.DomainInterfaceSource{
-				Network: &libvirtxml.DomainInterfaceSourceNetwork{
-					Network: netName,
-				},
+	dom.Devices.Interfaces = []libvirtxml.DomainInterface{}
+	for _, n := range networks {
+		iface := libvirtxml.DomainInterface{
+			MAC: &libvirtxml.DomainInterfaceMAC{
+				Address: n.GetMAC(name),
 			},
+			Source: &libvirtxml.DomainInterfaceSource{},
 			Model: &libvirtxml.DomainInterfaceModel{
-				Type: "virtio",
+				Type: n.GetModel(),
 			},
-		},
+		}
+		switch n.GetType() {
+		case ifaceTypeDirect:
+			iface.Source.Direct = &libvirtxml.DomainInterfaceSourceDirect{
+				Dev:  n.Name,
+				Mode: n.GetDirectMode(),
+			}
+		case ifaceTypeBridge:
+			iface.Source.Bridge = &libvirtxml.DomainInterfaceSourceBridge{
+				Bridge: n.Name,
+			}
+		default:
+			iface.Source.Network = &libvirtxml.DomainInterfaceSourceNetwork{
+				Network: n.Name,
+			}
+		}
+		dom.Devices.Interfaces = append(dom.Devices.Interfaces, iface)
 	}
 	dom.Devices.Disks = []libvirtxml.DomainDisk{
 		{
 			Driver: &libvirtxml.DomainDiskDriver{
 				Name:  "qemu",
-				Type:  "qcow2",
+				Type:  diskFormat,
 				Cache: "none",
 			},
 			Source: &libvirtxml.DomainDiskSource{
-				File: &libvirtxml.DomainDiskSourceFile{
-					File: diskPoolVolAbsPath,
+				Volume: &libvirtxml.DomainDiskSourceVolume{
+					Pool:   poolName,
+					Volume: volName,
 				},
 			},
 			Target: &libvirtxml.DomainDiskTarget{
@@ -59,4 +76,44 @@ func ConfigureDomainXML(dom *libvirtxml.Domain, name string, vcpu, memoryMiB uin
 			},
 		},
 	}
+	if len(shares) > 0 {
+		ConfigureDomainFilesystemsXML(dom, shares)
+	}
+}
+
+func ConfigureDomainFilesystemsXML(dom *libvirtxml.Domain, shares []Share) {
+	sharedMemory := false
+	dom.Devices.Filesystems = []libvirtxml.DomainFilesystem{}
+	for _, share := range shares {
+		fs := libvirtxml.DomainFilesystem{
+			Source: &libvirtxml.DomainFilesystemSource{
+				Mount: &libvirtxml.DomainFilesystemSourceMount{
+					Dir: share.Source,
+				},
+			},
+			Target: &libvirtxml.DomainFilesystemTarget{
+				Dir: share.Tag,
+			},
+		}
+		if share.GetDriver() == shareDriverVirtiofs {
+			// virtiofsd requires guest memory to be shared with the host
+			sharedMemory = true
+			fs.AccessMode = "passthrough"
+			fs.Driver = &libvirtxml.DomainFilesystemDriver{Type: "virtiofs"}
+		} else {
+			fs.AccessMode = "mapped"
+			fs.Driver = &libvirtxml.DomainFilesystemDriver{Type: "path"}
+		}
+		if share.ReadOnly {
+			fs.ReadOnly = &libvirtxml.DomainFilesystemReadOnly{}
+		}
+		dom.Devices.Filesystems = append(dom.Devices.Filesystems, fs)
+	}
+	if sharedMemory {
+		if dom.MemoryBacking == nil {
+			dom.MemoryBacking = &libvirtxml.DomainMemoryBacking{}
+		}
+		dom.MemoryBacking.MemorySource = &libvirtxml.DomainMemorySource{Type: "memfd"}
+		dom.MemoryBacking.MemoryAccess = &libvirtxml.DomainMemoryAccess{Mode: "shared"}
+	}
 }
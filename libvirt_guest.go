@@ -1,16 +1,20 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/libvirt/libvirt-go"
 )
 
 const (
-	waitInterval = 5
+	waitInterval      = 5
+	guestExecInterval = 250 * time.Millisecond
+	guestFileReadSize = 48 * 1024
 )
 
 type (
@@ -21,6 +25,17 @@ type (
 	guestAgentReturn struct {
 		Return any `json:"return"`
 	}
+	guestExecStatus struct {
+		Exited   bool   `json:"exited"`
+		ExitCode int    `json:"exitcode"`
+		OutData  []byte `json:"out-data"`
+		ErrData  []byte `json:"err-data"`
+	}
+	guestFileRead struct {
+		Count int    `json:"count"`
+		Buf   []byte `json:"buf-b64"`
+		EOF   bool   `json:"eof"`
+	}
 )
 
 func WaitUntilPing(dom *libvirt.Domain, waitSecs int) error {
@@ -46,7 +61,7 @@ func ExecuteQemuAgentCommand(dom *libvirt.Domain, commandName string, timeout in
 	req := &guestAgentCommand{Execute: commandName}
 	if len(arguments) > 1 {
 		req.Arguments = map[string]any{}
-		for i := 0; i < len(arguments)/2+1; i += 2 {
+		for i := 0; i+1 < len(arguments); i += 2 {
 			req.Arguments[arguments[i].(string)] = arguments[i+1]
 		}
 	}
@@ -66,3 +81,100 @@ func ExecuteQemuAgentCommand(dom *libvirt.Domain, commandName string, timeout in
 	//log.Printf("running command for domain %q: response %s", domainName, string(resBytes))
 	return res.Return, nil
 }
+
+func decodeQemuAgentReturn(ret any, v any) error {
+	retBytes, err := json.Marshal(ret)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(retBytes, v)
+}
+
+func ExecuteGuestCommand(dom *libvirt.Domain, timeoutSecs int, path string, args ...string) (*guestExecStatus, error) {
+	ret, err := ExecuteQemuAgentCommand(dom,
+		"guest-exec", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
+		"path", path,
+		"arg", args,
+		"capture-output", true)
+	if err != nil {
+		return nil, err
+	}
+	pid := struct {
+		PID int `json:"pid"`
+	}{}
+	if err := decodeQemuAgentReturn(ret, &pid); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(time.Duration(timeoutSecs) * time.Second)
+	for time.Now().Before(deadline) {
+		ret, err := ExecuteQemuAgentCommand(dom,
+			"guest-exec-status", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
+			"pid", pid.PID)
+		if err != nil {
+			return nil, err
+		}
+		status := &guestExecStatus{}
+		if err := decodeQemuAgentReturn(ret, status); err != nil {
+			return nil, err
+		} else if status.Exited {
+			if status.ExitCode != 0 {
+				return status, fmt.Errorf("guest command %q exited %d: %s", strings.Join(append([]string{path}, args...), " "), status.ExitCode, strings.TrimSpace(string(status.ErrData)))
+			}
+			return status, nil
+		}
+		time.Sleep(guestExecInterval)
+	}
+	return nil, fmt.Errorf("guest command %q did not exit within %d sec timeout", path, timeoutSecs)
+}
+
+func ReadGuestFile(dom *libvirt.Domain, path string) ([]byte, error) {
+	handle, err := ExecuteQemuAgentCommand(dom,
+		"guest-file-open", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
+		"path", path,
+		"mode", "r")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer ExecuteQemuAgentCommand(dom,
+		"guest-file-close", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
+		"handle", handle)
+	data := []byte{}
+	for {
+		ret, err := ExecuteQemuAgentCommand(dom,
+			"guest-file-read", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
+			"handle", handle,
+			"count", guestFileReadSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		read := &guestFileRead{}
+		if err := decodeQemuAgentReturn(ret, read); err != nil {
+			return nil, err
+		}
+		data = append(data, read.Buf...)
+		if read.EOF || read.Count == 0 {
+			return data, nil
+		}
+	}
+}
+
+func WriteGuestFile(dom *libvirt.Domain, path, mode string, data []byte) error {
+	handle, err := ExecuteQemuAgentCommand(dom,
+		"guest-file-open", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
+		"path", path,
+		"mode", mode)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	_, err = ExecuteQemuAgentCommand(dom,
+		"guest-file-write", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
+		"handle", handle,
+		"buf-b64", base64.StdEncoding.EncodeToString(data),
+		"count", len(data))
+	if _, cErr := ExecuteQemuAgentCommand(dom,
+		"guest-file-close", int(libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT),
+		"handle", handle); cErr != nil {
+		log.Printf("failed to close %s: %v", path, cErr)
+	}
+	return err
+}
@@ -1,101 +1,626 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
-	"math"
 	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/libvirt/libvirt-go"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
 
+// BroadcastAddr is the last address of the prefix (the broadcast address for IPv4)
 func BroadcastAddr(p netip.Prefix) netip.Addr {
-	n := binary.BigEndian.Uint32(p.Addr().AsSlice()) + uint32(1<<(32-p.Bits()))
-	npb := make([]byte, 4)
-	binary.BigEndian.PutUint32(npb, n)
-	na, _ := netip.AddrFromSlice(npb)
-	return na.Prev()
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i += 1 {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
 }
 
+// MaskAddr is the netmask of the prefix in the same address family
 func MaskAddr(p netip.Prefix) netip.Addr {
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, ((1<<p.Bits())-1)<<(32-p.Bits()))
+	b := make([]byte, p.Addr().BitLen()/8)
+	for i := 0; i < p.Bits(); i += 1 {
+		b[i/8] |= 1 << (7 - i%8)
+	}
 	mask, _ := netip.AddrFromSlice(b)
 	return mask
 }
 
-func MaskBits(mask netip.Addr) int {
-	n := binary.LittleEndian.Uint32(mask.AsSlice()) + 1
-	bits := int(math.Log2(float64(n)))
-	return bits
+// MaskBits counts the prefix bits of a netmask, failing for non-contiguous masks
+func MaskBits(mask netip.Addr) (int, error) {
+	b := mask.AsSlice()
+	bits := 0
+	for bits < len(b)*8 && b[bits/8]&(1<<(7-bits%8)) != 0 {
+		bits += 1
+	}
+	for i := bits; i < len(b)*8; i += 1 {
+		if b[i/8]&(1<<(7-i%8)) != 0 {
+			return 0, fmt.Errorf("netmask %s is not contiguous", mask)
+		}
+	}
+	return bits, nil
 }
 
+// PrefixMaskToCIDR converts an address and a netmask (i.e. 255.255.255.0) or prefix length (i.e. 64) to a prefix
 func PrefixMaskToCIDR(prefixStr, maskStr string) (netip.Prefix, error) {
 	prefix, err := netip.ParseAddr(prefixStr)
 	if err != nil {
 		return netip.Prefix{}, err
 	}
+	if bits, err := strconv.Atoi(maskStr); err == nil {
+		return prefix.Prefix(bits)
+	}
 	mask, err := netip.ParseAddr(maskStr)
+	if err != nil {
+		return netip.Prefix{}, err
+	} else if mask.BitLen() != prefix.BitLen() {
+		return netip.Prefix{}, fmt.Errorf("netmask %s does not match address family of %s", mask, prefix)
+	}
+	bits, err := MaskBits(mask)
 	if err != nil {
 		return netip.Prefix{}, err
 	}
-	bits := MaskBits(mask)
 	return prefix.Prefix(bits)
 }
 
-func GetDomainInterfaces(dom *libvirt.Domain) ([]libvirt.DomainInterface, error) {
-	sources := []libvirt.DomainInterfaceAddressesSource{
-		//libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+// NetworkIPPrefix is the prefix of a network <ip> block, which has either a netmask or a prefix
+func NetworkIPPrefix(ip libvirtxml.NetworkIP) (netip.Prefix, error) {
+	if ip.Netmask != "" {
+		return PrefixMaskToCIDR(ip.Address, ip.Netmask)
+	}
+	return PrefixMaskToCIDR(ip.Address, strconv.Itoa(int(ip.Prefix)))
+}
+
+// NetworkIPXML is a network <ip> block for the prefix with the first address as the gateway
+// and a DHCP range covering the remaining addresses
+func NetworkIPXML(prefix netip.Prefix, dhcp bool) libvirtxml.NetworkIP {
+	prefix = prefix.Masked()
+	ip := libvirtxml.NetworkIP{
+		Address:  prefix.Addr().Next().String(),
+		LocalPtr: "yes",
+	}
+	if prefix.Addr().Is4() {
+		ip.Netmask = MaskAddr(prefix).String()
+	} else {
+		ip.Family = "ipv6"
+		ip.Prefix = uint(prefix.Bits())
+	}
+	if dhcp {
+		ip.DHCP = &libvirtxml.NetworkDHCP{
+			Ranges: []libvirtxml.NetworkDHCPRange{
+				{
+					Start: prefix.Addr().Next().Next().String(),
+					End:   BroadcastAddr(prefix).Prev().String(),
+					Lease: &libvirtxml.NetworkDHCPLease{
+						Expiry: 1,
+						Unit:   "hours",
+					},
+				},
+			},
+		}
+	}
+	return ip
+}
+
+const (
+	netModeNAT      = "nat"
+	netModeRoute    = "route"
+	netModeOpen     = "open"
+	netModeIsolated = "isolated"
+	netModeBridge   = "bridge"
+)
+
+const (
+	ifaceTypeNetwork = "network"
+	ifaceTypeDirect  = "direct"
+	ifaceTypeBridge  = "bridge"
+)
+
+type DomainNetwork struct {
+	Name    string // libvirt network name, hypervisor NIC (direct) or existing host bridge (bridge)
+	Type    string // interface type: network (default), direct (macvtap) or bridge
+	Mode    string // network mode to create the network (other than Net), or the macvtap mode (default bridge)
+	Model   string // interface model (default virtio)
+	MAC     string // interface MAC (default derived from the domain and network names)
+	IP      string // fixed IP reserved in the network DHCP
+	Primary bool   // interface used for ssh, rsync, etc (default first)
+	Range   string // private cidr or "auto", to create the network when it doesn't exist (other than Net)
+	Bridge  string // interface name or "auto", to create the network when it doesn't exist (other than Net)
+}
+
+func (n DomainNetwork) GetType() string {
+	if n.Type == "" {
+		return ifaceTypeNetwork
+	}
+	return n.Type
+}
+
+// IsLibvirtNetwork is false for interfaces attached directly to the hypervisor's LAN
+func (n DomainNetwork) IsLibvirtNetwork() bool {
+	return n.GetType() == ifaceTypeNetwork
+}
+
+func (n DomainNetwork) GetDirectMode() string {
+	if n.Mode == "" {
+		return "bridge"
+	}
+	return n.Mode
+}
+
+func (n DomainNetwork) Validate() error {
+	switch n.GetType() {
+	case ifaceTypeNetwork, ifaceTypeBridge:
+	case ifaceTypeDirect:
+		switch n.GetDirectMode() {
+		case "vepa", "bridge", "private", "passthrough":
+		default:
+			return fmt.Errorf("network %q macvtap mode %q is not supported (use vepa, bridge, private or passthrough)", n.Name, n.Mode)
+		}
+	default:
+		return fmt.Errorf("network %q type %q is not supported (use network, direct or bridge)", n.Name, n.Type)
+	}
+	return nil
+}
+
+func (n DomainNetwork) GetModel() string {
+	if n.Model == "" {
+		return "virtio"
+	}
+	return n.Model
+}
+
+func (n DomainNetwork) GetMAC(domName string) string {
+	if n.MAC == "" {
+		return DomainMAC(domName, n.Name)
+	}
+	return n.MAC
+}
+
+// GetNetworks is the domain's networks, Net when Networks isn't configured
+func (c *Config) GetNetworks() []DomainNetwork {
+	if len(c.Networks) == 0 {
+		return []DomainNetwork{{Name: c.Net, IP: c.IP, Primary: true}}
+	}
+	return c.Networks
+}
+
+func (c *Config) GetPrimaryNetwork() DomainNetwork {
+	networks := c.GetNetworks()
+	for _, n := range networks {
+		if n.Primary {
+			return n
+		}
+	}
+	return networks[0]
+}
+
+// usesNet is true when one of the domain's interfaces is on the libvirt network Net
+func (c *Config) usesNet() bool {
+	for _, n := range c.GetNetworks() {
+		if n.Name == c.Net && n.IsLibvirtNetwork() {
+			return true
+		}
+	}
+	return false
+}
+
+// addressSources are where to look up domain addresses. Only the guest agent knows the addresses
+// of interfaces outside of libvirt networks, otherwise DHCP leases are the fallback.
+func (c *Config) addressSources() []libvirt.DomainInterfaceAddressesSource {
+	if c.GetPrimaryNetwork().IsLibvirtNetwork() {
+		return []libvirt.DomainInterfaceAddressesSource{
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+		}
+	}
+	return []libvirt.DomainInterfaceAddressesSource{
 		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
 	}
-	for _, source := range sources {
-		if ifaces, err := dom.ListAllInterfaceAddresses(source); err != nil {
+}
+
+// domainUsesNetwork checks the domain definition for an interface on the libvirt network
+func domainUsesNetwork(dom *libvirt.Domain, netName string) (bool, error) {
+	domXML, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return false, err
+	}
+	domDef := &libvirtxml.Domain{}
+	if err := domDef.Unmarshal(domXML); err != nil {
+		return false, err
+	} else if domDef.Devices == nil {
+		return false, nil
+	}
+	for _, iface := range domDef.Devices.Interfaces {
+		if iface.Source != nil && iface.Source.Network != nil && iface.Source.Network.Network == netName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// networkConfig is a copy of the config for creating one of the domain's other networks
+func (c *Config) networkConfig(n DomainNetwork) *Config {
+	nc := *c
+	nc.Net, nc.NetMode, nc.NetRange, nc.NetBridge = n.Name, n.Mode, n.Range, n.Bridge
+	nc.NetRange6 = ""
+	return &nc
+}
+
+// GetNetMode is the network forward mode, nat by default like libvirt's <forward/>
+func (c *Config) GetNetMode() string {
+	if c.NetMode == "" {
+		return netModeNAT
+	}
+	return c.NetMode
+}
+
+// NetworkXML is the desired network definition for the config
+func (c *Config) NetworkXML() (*libvirtxml.Network, error) {
+	net := &libvirtxml.Network{
+		Name: c.Net,
+		Bridge: &libvirtxml.NetworkBridge{
+			Name: c.NetBridge,
+		},
+	}
+	switch mode := c.GetNetMode(); mode {
+	case netModeBridge:
+		// an existing host bridge, addressing is handled outside of libvirt
+		net.Forward = &libvirtxml.NetworkForward{Mode: mode}
+		return net, nil
+	case netModeNAT, netModeRoute, netModeOpen:
+		net.Forward = &libvirtxml.NetworkForward{Mode: mode}
+	case netModeIsolated:
+		// no <forward>, domains can only reach each other and the hypervisor
+	default:
+		return nil, fmt.Errorf("net mode %q is not supported (use nat, route, open, isolated or bridge)", mode)
+	}
+	net.Domain = c.NetworkDomainXML()
+	net.DNS = &libvirtxml.NetworkDNS{
+		ForwardPlainNames: "no",
+		Forwarders:        c.NetworkDNSForwardersXML(),
+		TXTs:              c.NetworkDNSTXTsXML(),
+		SRVs:              c.NetworkDNSSRVsXML(),
+	}
+	prefix, err := netip.ParsePrefix(c.NetRange)
+	if err != nil {
+		return nil, err
+	} else if !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("NetRange %q is not an ipv4 range", c.NetRange)
+	}
+	net.IPs = []libvirtxml.NetworkIP{NetworkIPXML(prefix, true)}
+	if c.NetRange6 != "" {
+		prefix6, err := netip.ParsePrefix(c.NetRange6)
+		if err != nil {
 			return nil, err
-		} else if len(ifaces) > 0 {
+		} else if !prefix6.Addr().Is6() {
+			return nil, fmt.Errorf("NetRange6 %q is not an ipv6 range", c.NetRange6)
+		}
+		// without a dhcp range, addresses are assigned with router advertisements (SLAAC)
+		net.IPs = append(net.IPs, NetworkIPXML(prefix6, c.NetDHCP6))
+	}
+	return net, nil
+}
+
+// DomainMAC derives a stable locally administered MAC (qemu 52:54:00 prefix) from the domain and network names
+func DomainMAC(domName, netName string) string {
+	sum := sha256.Sum256([]byte(netName + "/" + domName))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[0], sum[1], sum[2])
+}
+
+func GetNetworkDef(net *libvirt.Network) (*libvirtxml.Network, error) {
+	netXML, err := net.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	netDef := &libvirtxml.Network{}
+	if err := netDef.Unmarshal(netXML); err != nil {
+		return nil, err
+	}
+	return netDef, nil
+}
+
+func GetDomainInterfaces(dom *libvirt.Domain, sources ...libvirt.DomainInterfaceAddressesSource) ([]libvirt.DomainInterface, error) {
+	if len(sources) == 0 {
+		sources = []libvirt.DomainInterfaceAddressesSource{
+			//libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
+		}
+	}
+	var err error
+	for _, source := range sources {
+		var ifaces []libvirt.DomainInterface
+		if ifaces, err = dom.ListAllInterfaceAddresses(source); err == nil && len(ifaces) > 0 {
 			return ifaces, nil
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 	return []libvirt.DomainInterface{}, nil
 }
 
-func (c *Config) getDomainIPAddress(dom *libvirt.Domain) (*libvirt.DomainIPAddress, error) {
-	if ifaces, err := GetDomainInterfaces(dom); err != nil {
+// getDomainIPAddresses returns the first IPv4 and first global IPv6 address of the domain interface
+// on the primary network, or of the first interface with addresses when no interface has its MAC
+func (c *Config) getDomainIPAddresses(dom *libvirt.Domain) ([]libvirt.DomainIPAddress, error) {
+	domName, _ := dom.GetName()
+	primary := c.GetPrimaryNetwork()
+	mac := DomainMAC(domName, primary.Name)
+	if domName == c.Name {
+		mac = primary.GetMAC(domName)
+	}
+	if ifaces, err := GetDomainInterfaces(dom, c.addressSources()...); err != nil {
 		return nil, err
 	} else if len(ifaces) > 0 {
+		if c.DomainIfname == "" {
+			// try the primary network's interface first
+			sort.SliceStable(ifaces, func(i, j int) bool {
+				return strings.EqualFold(ifaces[i].Hwaddr, mac) && !strings.EqualFold(ifaces[j].Hwaddr, mac)
+			})
+		}
 		for _, iface := range ifaces {
 			if c.DomainIfname != "" {
 				if c.DomainIfname != iface.Name {
 					continue
 				}
 				if c.Verbose {
-					domName, _ := dom.GetName()
 					log.Printf("domain %s selecting preferred interface %q", domName, iface.Name)
 				}
 			} else if iface.Name == "" || iface.Name == "lo" {
 				continue
 			}
+			addrs := []libvirt.DomainIPAddress{}
+			families := map[libvirt.IPAddrType]bool{}
 			for _, addr := range iface.Addrs {
-				if addr.Type == libvirt.IP_ADDR_TYPE_IPV4 {
-					return &addr, nil
+				if ip, err := netip.ParseAddr(addr.Addr); err != nil || ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+					continue
+				} else if !families[addr.Type] {
+					families[addr.Type] = true
+					addrs = append(addrs, addr)
 				}
 			}
+			if len(addrs) > 0 {
+				return addrs, nil
+			}
 		}
 	}
 	return nil, errors.New("domain interfaces not found")
 }
 
+// getDomainIPAddress returns the domain IPv4 address, or the IPv6 address when PreferIPv6 is set
+func (c *Config) getDomainIPAddress(dom *libvirt.Domain) (*libvirt.DomainIPAddress, error) {
+	addrs, err := c.getDomainIPAddresses(dom)
+	if err != nil {
+		return nil, err
+	}
+	preferred := libvirt.IP_ADDR_TYPE_IPV4
+	if c.PreferIPv6 {
+		preferred = libvirt.IP_ADDR_TYPE_IPV6
+	}
+	for _, addr := range addrs {
+		if addr.Type == preferred {
+			return &addr, nil
+		}
+	}
+	return &addrs[0], nil
+}
+
+// SSHHost formats an address for use in scp/rsync style "host:path" arguments
+func SSHHost(addr string) string {
+	if ip, err := netip.ParseAddr(addr); err == nil && ip.Is6() {
+		return "[" + addr + "]"
+	}
+	return addr
+}
+
 func GetNetworkPrefix(net *libvirt.Network) (netip.Prefix, error) {
-	netXML, err := net.GetXMLDesc(0)
+	prefixes, err := GetNetworkPrefixes(net)
 	if err != nil {
 		return netip.Prefix{}, err
 	}
-	netdef := &libvirtxml.Network{}
-	if err := netdef.Unmarshal(netXML); err != nil {
-		return netip.Prefix{}, err
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is4() {
+			return prefix, nil
+		}
+	}
+	return netip.Prefix{}, errors.New("network has no ipv4 ip section")
+}
+
+func GetNetworkPrefixes(net *libvirt.Network) ([]netip.Prefix, error) {
+	netdef, err := GetNetworkDef(net)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := []netip.Prefix{}
+	for _, ip := range netdef.IPs {
+		prefix, err := NetworkIPPrefix(ip)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func networkUpdateFlags(net *libvirt.Network) libvirt.NetworkUpdateFlags {
+	if active, err := net.IsActive(); err == nil && active {
+		return libvirt.NETWORK_UPDATE_AFFECT_LIVE | libvirt.NETWORK_UPDATE_AFFECT_CONFIG
 	}
-	return PrefixMaskToCIDR(netdef.IPs[0].Address, netdef.IPs[0].Netmask)
+	return libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+}
+
+// checkDomainIP validates that addr is a usable host address of the network
+func checkDomainIP(prefix netip.Prefix, addr netip.Addr) error {
+	if !prefix.Contains(addr) {
+		return fmt.Errorf("ip %s is not in network range %s", addr, prefix)
+	} else if addr == prefix.Masked().Addr() || addr == prefix.Masked().Addr().Next() || addr == BroadcastAddr(prefix) {
+		return fmt.Errorf("ip %s is the network, gateway or broadcast address of %s", addr, prefix)
+	}
+	return nil
+}
+
+// pickDomainIP chooses a stable address for the MAC within the prefix, skipping addresses in use
+func pickDomainIP(prefix netip.Prefix, mac string, used map[netip.Addr]bool) (netip.Addr, error) {
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() || prefix.Bits() > 30 {
+		return netip.Addr{}, fmt.Errorf("network range %s is too small", prefix)
+	}
+	// exclude network, gateway and broadcast addresses
+	hosts := uint32(1<<(32-prefix.Bits())) - 3
+	sum := sha256.Sum256([]byte(mac))
+	first := binary.BigEndian.Uint32(prefix.Addr().AsSlice()) + 2
+	offset := binary.BigEndian.Uint32(sum[:4]) % hosts
+	for i := uint32(0); i < hosts; i += 1 {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, first+(offset+i)%hosts)
+		addr, _ := netip.AddrFromSlice(b)
+		if !used[addr] {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("network range %s has no free addresses", prefix)
+}
+
+func (c *Config) getDHCPHost(netDef *libvirtxml.Network, n DomainNetwork) *libvirtxml.NetworkDHCPHost {
+	mac := n.GetMAC(c.Name)
+	for _, ip := range netDef.IPs {
+		if ip.DHCP == nil {
+			continue
+		}
+		for _, host := range ip.DHCP.Hosts {
+			if host.MAC == mac || host.Name == c.Name {
+				return &host
+			}
+		}
+	}
+	return nil
+}
+
+// forEachNetwork looks up each of the domain's networks, skipping networks that don't exist
+func (c *Config) forEachNetwork(fn func(net *libvirt.Network, n DomainNetwork) error) error {
+	for _, n := range c.GetNetworks() {
+		if !n.IsLibvirtNetwork() {
+			continue
+		} else if n.Name == c.Net {
+			if c.net == nil {
+				continue
+			} else if err := fn(c.net, n); err != nil {
+				return err
+			}
+			continue
+		}
+		net, err := c.conn.LookupNetworkByName(n.Name)
+		if IsErrorCode(err, libvirt.ERR_NO_NETWORK) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = fn(net, n)
+		net.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) initDHCPHosts() error {
+	return c.forEachNetwork(c.initDHCPHost)
+}
+
+func (c *Config) delDHCPHosts() error {
+	return c.forEachNetwork(c.delDHCPHost)
+}
+
+// initDHCPHost reserves the domain's IP (config IP or a stable address derived from its MAC) in the network
+func (c *Config) initDHCPHost(net *libvirt.Network, n DomainNetwork) error {
+	netDef, err := GetNetworkDef(net)
+	if err != nil {
+		return err
+	} else if len(netDef.IPs) == 0 || netDef.IPs[0].DHCP == nil {
+		log.Printf("WARN: network %q has no dhcp section, not reserving an ip for %q", n.Name, c.Name)
+		return nil
+	}
+	prefix, err := NetworkIPPrefix(netDef.IPs[0])
+	if err != nil {
+		return err
+	}
+	if n.Name == c.Net && c.NetRange != "" && c.NetRange != netAuto {
+		if prefix, err = netip.ParsePrefix(c.NetRange); err != nil {
+			return err
+		}
+	}
+	host := &libvirtxml.NetworkDHCPHost{MAC: n.GetMAC(c.Name), Name: c.Name}
+	used := map[netip.Addr]bool{}
+	for _, h := range netDef.IPs[0].DHCP.Hosts {
+		if addr, err := netip.ParseAddr(h.IP); err == nil && h.MAC != host.MAC && h.Name != host.Name {
+			used[addr] = true
+		}
+	}
+	if leases, err := net.GetDHCPLeases(); err == nil {
+		for _, lease := range leases {
+			if addr, err := netip.ParseAddr(lease.IPaddr); err == nil && lease.Mac != host.MAC {
+				used[addr] = true
+			}
+		}
+	}
+	if n.IP != "" {
+		addr, err := netip.ParseAddr(n.IP)
+		if err != nil {
+			return err
+		} else if err := checkDomainIP(prefix, addr); err != nil {
+			return err
+		} else if used[addr] {
+			return fmt.Errorf("ip %s is already reserved or leased in network %q", addr, n.Name)
+		}
+		host.IP = addr.String()
+	} else if addr, err := pickDomainIP(prefix, host.MAC, used); err != nil {
+		return err
+	} else {
+		host.IP = addr.String()
+	}
+	hostXML, err := host.Marshal()
+	if err != nil {
+		return err
+	}
+	if existing := c.getDHCPHost(netDef, n); existing == nil {
+		log.Printf("reserving ip %s (mac %s) for %q in network %q", host.IP, host.MAC, c.Name, n.Name)
+		return net.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, hostXML, networkUpdateFlags(net))
+	} else if existing.MAC != host.MAC || existing.Name != host.Name || (n.IP != "" && existing.IP != host.IP) {
+		log.Printf("updating ip reservation %s (mac %s) for %q in network %q", host.IP, host.MAC, c.Name, n.Name)
+		if err := c.delDHCPHost(net, n); err != nil {
+			return err
+		}
+		return net.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, hostXML, networkUpdateFlags(net))
+	} else if c.Verbose {
+		log.Printf("ip %s already reserved for %q in network %q", existing.IP, c.Name, n.Name)
+	}
+	return nil
+}
+
+func (c *Config) delDHCPHost(net *libvirt.Network, n DomainNetwork) error {
+	netDef, err := GetNetworkDef(net)
+	if err != nil {
+		return err
+	}
+	host := c.getDHCPHost(netDef, n)
+	if host == nil {
+		return nil
+	}
+	log.Printf("deleting ip reservation %s for %q in network %q", host.IP, c.Name, n.Name)
+	hostXML, err := host.Marshal()
+	if err != nil {
+		return err
+	}
+	return net.Update(libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, hostXML, networkUpdateFlags(net))
 }
 
 func (c *Config) syncDomainNamesToNetworkDNS() error {
@@ -129,28 +654,45 @@ func (c *Config) syncDomainNamesToNetworkDNS() error {
 		}
 	}
 	for _, dom := range doms {
+		domName, _ := dom.GetName()
+		if onNet, err := domainUsesNetwork(&dom, c.Net); err != nil {
+			return err
+		} else if !onNet {
+			if c.Verbose {
+				log.Printf("skipping dns entries for domain %q, not on network %q", domName, c.Net)
+			}
+			continue
+		}
 		ifaces, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT)
 		if err != nil {
 			return err
 		}
-		domName, _ := dom.GetName()
 		if len(ifaces) == 0 {
 			log.Printf("WARN: no dns entries for domain %q", domName)
 		}
-		domAddr, err := c.getDomainIPAddress(&dom)
-		if c.Verbose {
-			log.Printf("dns entry %q maps to %q", domName, domAddr.Addr)
-		}
-		h := libvirtxml.NetworkDNSHost{
-			Hostnames: []libvirtxml.NetworkDNSHostHostname{
-				{Hostname: domName},
-			},
-			IP: domAddr.Addr,
+		domAddrs, err := c.getDomainIPAddresses(&dom)
+		if err != nil {
+			log.Printf("WARN: no dns entries for domain %q: %v", domName, err)
+			continue
 		}
-		if hostXML, err := h.Marshal(); err != nil {
-			return err
-		} else if err := c.net.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_DNS_HOST, -1, hostXML, 0); err != nil {
-			return err
+		for _, domAddr := range domAddrs {
+			if domAddr.Type == libvirt.IP_ADDR_TYPE_IPV6 && c.NetRange6 == "" {
+				continue
+			}
+			if c.Verbose {
+				log.Printf("dns entry %q maps to %q", domName, domAddr.Addr)
+			}
+			h := libvirtxml.NetworkDNSHost{
+				Hostnames: []libvirtxml.NetworkDNSHostHostname{
+					{Hostname: domName},
+				},
+				IP: domAddr.Addr,
+			}
+			if hostXML, err := h.Marshal(); err != nil {
+				return err
+			} else if err := c.net.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_DNS_HOST, -1, hostXML, 0); err != nil {
+				return err
+			}
 		}
 		//for _, iface := range ifaces {
 		//	for _, addr := range iface.Addrs {
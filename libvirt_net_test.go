@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestBroadcastAndMaskAddr(t *testing.T) {
+	tests := []struct {
+		prefix    string
+		broadcast string
+		mask      string
+	}{
+		{"192.168.125.0/24", "192.168.125.255", "255.255.255.0"},
+		{"192.168.125.77/24", "192.168.125.255", "255.255.255.0"},
+		{"10.100.0.0/16", "10.100.255.255", "255.255.0.0"},
+		{"10.1.2.128/25", "10.1.2.255", "255.255.255.128"},
+		{"10.1.2.4/30", "10.1.2.7", "255.255.255.252"},
+		{"10.1.2.3/32", "10.1.2.3", "255.255.255.255"},
+		{"0.0.0.0/0", "255.255.255.255", "0.0.0.0"},
+		{"fd00:1::/64", "fd00:1::ffff:ffff:ffff:ffff", "ffff:ffff:ffff:ffff::"},
+		{"fd00:1::1234/64", "fd00:1::ffff:ffff:ffff:ffff", "ffff:ffff:ffff:ffff::"},
+		{"fd00:1:2:3::/60", "fd00:1:2:f:ffff:ffff:ffff:ffff", "ffff:ffff:ffff:fff0::"},
+		{"fd00::/127", "fd00::1", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe"},
+		{"fd00::5/128", "fd00::5", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"::/0", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "::"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			prefix := netip.MustParsePrefix(tt.prefix)
+			if got := BroadcastAddr(prefix); got != netip.MustParseAddr(tt.broadcast) {
+				t.Errorf("BroadcastAddr(%s) = %s, want %s", tt.prefix, got, tt.broadcast)
+			}
+			if got := MaskAddr(prefix); got != netip.MustParseAddr(tt.mask) {
+				t.Errorf("MaskAddr(%s) = %s, want %s", tt.prefix, got, tt.mask)
+			}
+		})
+	}
+}
+
+func TestMaskBits(t *testing.T) {
+	tests := []struct {
+		mask    string
+		bits    int
+		wantErr bool
+	}{
+		{"0.0.0.0", 0, false},
+		{"255.0.0.0", 8, false},
+		{"255.255.255.0", 24, false},
+		{"255.255.255.254", 31, false},
+		{"255.255.255.255", 32, false},
+		{"255.0.255.0", 0, true},
+		{"255.255.255.1", 0, true},
+		{"::", 0, false},
+		{"ffff:ffff:ffff:ffff::", 64, false},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe", 127, false},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", 128, false},
+		{"ffff::ffff", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mask, func(t *testing.T) {
+			bits, err := MaskBits(netip.MustParseAddr(tt.mask))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MaskBits(%s) error = %v, want error %v", tt.mask, err, tt.wantErr)
+			} else if bits != tt.bits {
+				t.Errorf("MaskBits(%s) = %d, want %d", tt.mask, bits, tt.bits)
+			}
+		})
+	}
+}
+
+// the prefix is masked to the network address
+func TestPrefixMaskToCIDR(t *testing.T) {
+	tests := []struct {
+		addr    string
+		mask    string
+		want    string
+		wantErr bool
+	}{
+		{"192.168.125.1", "255.255.255.0", "192.168.125.0/24", false},
+		{"192.168.125.1", "24", "192.168.125.0/24", false},
+		{"10.1.2.3", "255.255.255.255", "10.1.2.3/32", false},
+		{"10.1.2.3", "32", "10.1.2.3/32", false},
+		{"10.1.2.3", "33", "", true},
+		{"10.1.2.3", "255.0.255.0", "", true},
+		{"10.1.2.3", "ffff:ffff::", "", true},
+		{"fd00:1::1", "64", "fd00:1::/64", false},
+		{"fd00:1::1", "ffff:ffff:ffff:ffff::", "fd00:1::/64", false},
+		{"fd00::1", "127", "fd00::/127", false},
+		{"fd00::1", "128", "fd00::1/128", false},
+		{"fd00::1", "129", "", true},
+		{"fd00::1", "255.255.255.0", "", true},
+		{"not-an-ip", "24", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr+"/"+tt.mask, func(t *testing.T) {
+			got, err := PrefixMaskToCIDR(tt.addr, tt.mask)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PrefixMaskToCIDR(%s, %s) error = %v, want error %v", tt.addr, tt.mask, err, tt.wantErr)
+			} else if !tt.wantErr && got != netip.MustParsePrefix(tt.want) {
+				t.Errorf("PrefixMaskToCIDR(%s, %s) = %s, want %s", tt.addr, tt.mask, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+const (
+	netAuto            = "auto"
+	netAutoBits        = 24
+	netAutoBridge      = "virbr"
+	defaultNetSupernet = "10.100.0.0/16"
+)
+
+type (
+	// usedNetwork is a range or bridge already taken on the hypervisor or the workstation
+	usedNetwork struct {
+		Prefix netip.Prefix
+		Owner  string // i.e. libvirt network "default" or local route via 192.168.1.1
+	}
+	usedNetworks struct {
+		prefixes []usedNetwork
+		bridges  map[string]string
+	}
+)
+
+func (c *Config) GetNetSupernet() string {
+	if c.NetSupernet == "" {
+		return defaultNetSupernet
+	}
+	return c.NetSupernet
+}
+
+// overlaps finds a used range overlapping prefix
+func (u *usedNetworks) overlaps(prefix netip.Prefix) *usedNetwork {
+	for _, used := range u.prefixes {
+		if used.Prefix.Overlaps(prefix) {
+			return &used
+		}
+	}
+	return nil
+}
+
+// listUsedNetworks collects the ranges and bridges of every libvirt network except skipNet, and the workstation's routes
+func (c *Config) listUsedNetworks(skipNet string) (*usedNetworks, error) {
+	used := &usedNetworks{bridges: map[string]string{}}
+	nets, err := c.conn.ListAllNetworks(0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, net := range nets {
+			net.Free()
+		}
+	}()
+	for _, net := range nets {
+		netDef, err := GetNetworkDef(&net)
+		if err != nil {
+			return nil, err
+		} else if netDef.Name == skipNet {
+			continue
+		}
+		if netDef.Bridge != nil && netDef.Bridge.Name != "" {
+			used.bridges[netDef.Bridge.Name] = fmt.Sprintf("libvirt network %q", netDef.Name)
+		}
+		for _, ip := range netDef.IPs {
+			prefix, err := NetworkIPPrefix(ip)
+			if err != nil {
+				return nil, err
+			}
+			used.prefixes = append(used.prefixes, usedNetwork{prefix.Masked(), fmt.Sprintf("libvirt network %q", netDef.Name)})
+		}
+	}
+	// host interfaces need netcf on the hypervisor, not every libvirt build has it
+	if ifaces, err := c.conn.ListAllInterfaces(0); err == nil {
+		for _, iface := range ifaces {
+			if name, err := iface.GetName(); err == nil {
+				if _, ok := used.bridges[name]; !ok {
+					used.bridges[name] = "hypervisor interface"
+				}
+			}
+			iface.Free()
+		}
+	}
+	routes, err := listRoutes()
+	if errors.Is(err, errRoutesUnsupported) {
+		log.Printf("WARN: not checking local routes for overlaps: %v", err)
+		return used, nil
+	} else if err != nil {
+		return nil, err
+	}
+	host, _ := c.GetHypervisorHost()
+	for _, route := range routes {
+		if route.Dst.Bits() == 0 {
+			// default routes overlap everything
+			continue
+		} else if route.Gateway.IsValid() && route.Gateway.String() == host {
+			// routes to the hypervisor's networks (-addroutes), stale ones would block their own range
+			continue
+		}
+		owner := "local route " + route.Dst.String()
+		if route.Gateway.IsValid() {
+			owner += " via " + route.Gateway.String()
+		}
+		used.prefixes = append(used.prefixes, usedNetwork{route.Dst, owner})
+	}
+	return used, nil
+}
+
+// allocNetRange picks the first free /24 in the supernet
+func allocNetRange(supernet netip.Prefix, used *usedNetworks) (netip.Prefix, error) {
+	if !supernet.Addr().Is4() || supernet.Bits() > netAutoBits {
+		return netip.Prefix{}, fmt.Errorf("NetSupernet %q must be an ipv4 range of /%d or larger", supernet, netAutoBits)
+	}
+	supernet = supernet.Masked()
+	for prefix := netip.PrefixFrom(supernet.Addr(), netAutoBits); supernet.Contains(prefix.Addr()); {
+		if used.overlaps(prefix) == nil {
+			return prefix, nil
+		}
+		next := BroadcastAddr(prefix).Next()
+		if !next.IsValid() {
+			break
+		}
+		prefix = netip.PrefixFrom(next, netAutoBits)
+	}
+	return netip.Prefix{}, fmt.Errorf("no free /%d left in NetSupernet %s", netAutoBits, supernet)
+}
+
+// allocNetBridge picks the first unused virbrN
+func allocNetBridge(used *usedNetworks) string {
+	for i := 0; ; i++ {
+		if bridge := fmt.Sprintf("%s%d", netAutoBridge, i); used.bridges[bridge] == "" {
+			return bridge
+		}
+	}
+}
+
+// resolveAutoNetwork takes "auto" NetRange and NetBridge from an existing network
+func (c *Config) resolveAutoNetwork(net *libvirt.Network) error {
+	if c.NetRange != netAuto && c.NetBridge != netAuto {
+		return nil
+	}
+	netDef, err := GetNetworkDef(net)
+	if err != nil {
+		return err
+	}
+	if c.NetBridge == netAuto && netDef.Bridge != nil {
+		c.NetBridge = netDef.Bridge.Name
+	}
+	if c.NetRange == netAuto {
+		for _, ip := range netDef.IPs {
+			if prefix, err := NetworkIPPrefix(ip); err != nil {
+				return err
+			} else if prefix.Addr().Is4() {
+				c.NetRange = prefix.Masked().String()
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// allocNetwork replaces "auto" NetRange and NetBridge of nc with a free range and bridge,
+// and checks explicit ones for overlaps before the network is created
+func (c *Config) allocNetwork(nc *Config) error {
+	if nc.GetNetMode() == netModeBridge {
+		if nc.NetBridge == netAuto {
+			return fmt.Errorf("net %q in bridge mode needs an existing host bridge, not %q", nc.Net, netAuto)
+		}
+		return nil
+	}
+	log.Printf("checking ranges in use for net %q...", nc.Net)
+	used, err := c.listUsedNetworks(nc.Net)
+	if err != nil {
+		return err
+	}
+	if nc.NetRange == netAuto {
+		supernet, err := netip.ParsePrefix(c.GetNetSupernet())
+		if err != nil {
+			return err
+		}
+		prefix, err := allocNetRange(supernet, used)
+		if err != nil {
+			return err
+		}
+		nc.NetRange = prefix.String()
+		log.Printf("allocated range %s for net %q", nc.NetRange, nc.Net)
+	} else if prefix, err := netip.ParsePrefix(nc.NetRange); err != nil {
+		return fmt.Errorf("net %q range %q: %w", nc.Net, nc.NetRange, err)
+	} else if overlap := used.overlaps(prefix.Masked()); overlap != nil {
+		return fmt.Errorf("net %q range %s overlaps %s (%s), choose another range or use %q", nc.Net, prefix, overlap.Prefix, overlap.Owner, netAuto)
+	}
+	if nc.NetBridge == netAuto {
+		nc.NetBridge = allocNetBridge(used)
+		log.Printf("allocated bridge %s for net %q", nc.NetBridge, nc.Net)
+	} else if owner := used.bridges[nc.NetBridge]; nc.NetBridge != "" && strings.HasPrefix(owner, "libvirt") {
+		return fmt.Errorf("net %q bridge %s is already used by %s", nc.Net, nc.NetBridge, owner)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// usedPrefixes builds the used ranges, owners named after the prefix
+func usedPrefixes(prefixes ...string) *usedNetworks {
+	used := &usedNetworks{bridges: map[string]string{}}
+	for _, prefix := range prefixes {
+		used.prefixes = append(used.prefixes, usedNetwork{netip.MustParsePrefix(prefix), "used " + prefix})
+	}
+	return used
+}
+
+func TestAllocNetRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		supernet string
+		used     []string
+		want     string
+		wantErr  bool
+	}{
+		{"first free", "10.100.0.0/16", nil, "10.100.0.0/24", false},
+		{"supernet host bits", "10.100.5.7/16", nil, "10.100.0.0/24", false},
+		{"skip libvirt range", "10.100.0.0/16", []string{"10.100.0.0/24"}, "10.100.1.0/24", false},
+		{"skip larger range", "10.100.0.0/16", []string{"10.100.0.0/23"}, "10.100.2.0/24", false},
+		{"skip ranges and routes", "10.100.0.0/16", []string{"10.100.0.0/24", "10.100.1.0/24", "10.100.2.128/25"}, "10.100.3.0/24", false},
+		{"outside supernet", "10.100.0.0/16", []string{"192.168.125.0/24", "10.99.0.0/16"}, "10.100.0.0/24", false},
+		{"single /24", "10.100.7.0/24", nil, "10.100.7.0/24", false},
+		{"exhausted", "10.100.0.0/23", []string{"10.100.0.0/24", "10.100.1.0/24"}, "", true},
+		{"covering route", "10.100.0.0/16", []string{"10.0.0.0/8"}, "", true},
+		{"end of address space", "255.255.255.0/24", []string{"255.255.255.0/24"}, "", true},
+		{"ipv6 supernet", "fd00:1::/48", nil, "", true},
+		{"smaller than /24", "10.100.0.0/25", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := allocNetRange(netip.MustParsePrefix(tt.supernet), usedPrefixes(tt.used...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("allocNetRange(%s) error = %v, want error %v", tt.supernet, err, tt.wantErr)
+			} else if !tt.wantErr && got != netip.MustParsePrefix(tt.want) {
+				t.Errorf("allocNetRange(%s) = %s, want %s", tt.supernet, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsedNetworksOverlaps(t *testing.T) {
+	used := usedPrefixes("192.168.122.0/24", "10.100.0.0/23")
+	tests := []struct {
+		prefix string
+		owner  string
+	}{
+		{"192.168.122.0/24", "used 192.168.122.0/24"},
+		{"192.168.122.128/25", "used 192.168.122.0/24"},
+		{"192.168.0.0/16", "used 192.168.122.0/24"},
+		{"10.100.1.0/24", "used 10.100.0.0/23"},
+		{"192.168.123.0/24", ""},
+		{"10.100.2.0/24", ""},
+		{"fd00::/64", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			owner := ""
+			if overlap := used.overlaps(netip.MustParsePrefix(tt.prefix)); overlap != nil {
+				owner = overlap.Owner
+			}
+			if owner != tt.owner {
+				t.Errorf("overlaps(%s) = %q, want %q", tt.prefix, owner, tt.owner)
+			}
+		})
+	}
+}
+
+func TestAllocNetBridge(t *testing.T) {
+	tests := []struct {
+		name    string
+		bridges []string
+		want    string
+	}{
+		{"none used", nil, "virbr0"},
+		{"next free", []string{"virbr0", "virbr1"}, "virbr2"},
+		{"gap", []string{"virbr0", "virbr2"}, "virbr1"},
+		{"other bridges", []string{"br0", "docker0"}, "virbr0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := usedPrefixes()
+			for _, bridge := range tt.bridges {
+				used.bridges[bridge] = "hypervisor interface"
+			}
+			if got := allocNetBridge(used); got != tt.want {
+				t.Errorf("allocNetBridge(%v) = %s, want %s", tt.bridges, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// networkIPKey identifies a network <ip> by its address and prefix, ignoring how libvirt formats them
+func networkIPKey(ip libvirtxml.NetworkIP) (string, error) {
+	prefix, err := NetworkIPPrefix(ip)
+	if err != nil {
+		return "", err
+	}
+	addr, err := netip.ParseAddr(ip.Address)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d", addr, prefix.Bits()), nil
+}
+
+func marshalDHCPRanges(ip libvirtxml.NetworkIP) ([]string, error) {
+	ranges := []string{}
+	if ip.DHCP == nil {
+		return ranges, nil
+	}
+	for _, r := range ip.DHCP.Ranges {
+		record, err := r.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, record)
+	}
+	return ranges, nil
+}
+
+// networkRestartChanges lists the differences between the running and desired network that libvirt can't update live
+func networkRestartChanges(current, desired *libvirtxml.Network) ([]string, error) {
+	changes := []string{}
+	forwardMode := func(n *libvirtxml.Network) string {
+		if n.Forward == nil {
+			return netModeIsolated
+		}
+		return n.Forward.Mode
+	}
+	if current, desired := forwardMode(current), forwardMode(desired); current != desired {
+		changes = append(changes, fmt.Sprintf("forward mode %s -> %s", current, desired))
+	}
+	if desired.Bridge != nil && desired.Bridge.Name != "" && (current.Bridge == nil || current.Bridge.Name != desired.Bridge.Name) {
+		changes = append(changes, fmt.Sprintf("bridge -> %s", desired.Bridge.Name))
+	}
+	domain := func(n *libvirtxml.Network) string {
+		if n.Domain == nil {
+			return "none"
+		}
+		return fmt.Sprintf("%s (localOnly %q)", n.Domain.Name, n.Domain.LocalOnly)
+	}
+	if current, desired := domain(current), domain(desired); current != desired {
+		changes = append(changes, fmt.Sprintf("dns domain %s -> %s", current, desired))
+	}
+	currentDNS, desiredDNS := current.DNS, desired.DNS
+	if currentDNS == nil {
+		currentDNS = &libvirtxml.NetworkDNS{}
+	}
+	if desiredDNS == nil {
+		desiredDNS = &libvirtxml.NetworkDNS{}
+	}
+	if fmt.Sprint(currentDNS.Forwarders) != fmt.Sprint(desiredDNS.Forwarders) {
+		changes = append(changes, fmt.Sprintf("dns forwarders %v -> %v", currentDNS.Forwarders, desiredDNS.Forwarders))
+	}
+	currentIPs := map[string]libvirtxml.NetworkIP{}
+	for _, ip := range current.IPs {
+		key, err := networkIPKey(ip)
+		if err != nil {
+			return nil, err
+		}
+		currentIPs[key] = ip
+	}
+	desiredIPs := map[string]bool{}
+	for _, ip := range desired.IPs {
+		key, err := networkIPKey(ip)
+		if err != nil {
+			return nil, err
+		}
+		desiredIPs[key] = true
+		if currentIP, ok := currentIPs[key]; !ok {
+			changes = append(changes, fmt.Sprintf("add ip %s", key))
+		} else if (currentIP.DHCP == nil) != (ip.DHCP == nil) {
+			changes = append(changes, fmt.Sprintf("dhcp on ip %s", key))
+		}
+	}
+	for key := range currentIPs {
+		if !desiredIPs[key] {
+			changes = append(changes, fmt.Sprintf("remove ip %s", key))
+		}
+	}
+	return changes, nil
+}
+
+// updateNetworkLive applies the dhcp range, TXT and SRV differences with network updates
+func updateNetworkLive(net *libvirt.Network, current, desired *libvirtxml.Network) error {
+	for i, ip := range current.IPs {
+		key, err := networkIPKey(ip)
+		if err != nil {
+			return err
+		}
+		for _, desiredIP := range desired.IPs {
+			if desiredKey, err := networkIPKey(desiredIP); err != nil {
+				return err
+			} else if desiredKey != key || ip.DHCP == nil || desiredIP.DHCP == nil {
+				continue
+			}
+			currentRanges, err := marshalDHCPRanges(ip)
+			if err != nil {
+				return err
+			}
+			desiredRanges, err := marshalDHCPRanges(desiredIP)
+			if err != nil {
+				return err
+			}
+			// add first, libvirt refuses to delete the last range
+			for _, r := range desiredRanges {
+				if !containsString(currentRanges, r) {
+					log.Printf("adding dhcp range %s", r)
+					if err := net.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_RANGE, i, r, networkUpdateFlags(net)); err != nil {
+						return err
+					}
+				}
+			}
+			for _, r := range currentRanges {
+				if !containsString(desiredRanges, r) {
+					log.Printf("deleting dhcp range %s", r)
+					if err := net.Update(libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_IP_DHCP_RANGE, i, r, networkUpdateFlags(net)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	currentDNS, desiredDNS := current.DNS, desired.DNS
+	if currentDNS == nil {
+		currentDNS = &libvirtxml.NetworkDNS{}
+	}
+	if desiredDNS == nil {
+		desiredDNS = &libvirtxml.NetworkDNS{}
+	}
+	if currentTXTs, err := marshalDNSTXTs(currentDNS.TXTs); err != nil {
+		return err
+	} else if desiredTXTs, err := marshalDNSTXTs(desiredDNS.TXTs); err != nil {
+		return err
+	} else if err := updateDNSRecords(net, libvirt.NETWORK_SECTION_DNS_TXT, currentTXTs, desiredTXTs); err != nil {
+		return err
+	}
+	if currentSRVs, err := marshalDNSSRVs(currentDNS.SRVs); err != nil {
+		return err
+	} else if desiredSRVs, err := marshalDNSSRVs(desiredDNS.SRVs); err != nil {
+		return err
+	} else if err := updateDNSRecords(net, libvirt.NETWORK_SECTION_DNS_SRV, currentSRVs, desiredSRVs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// carryNetworkHosts copies the dhcp reservations and dns hosts (managed by -adddom and -syncdns) into the
+// desired definition, dropping reservations outside of the new ranges
+func carryNetworkHosts(current, desired *libvirtxml.Network) error {
+	for _, ip := range current.IPs {
+		if ip.DHCP == nil {
+			continue
+		}
+		for _, host := range ip.DHCP.Hosts {
+			addr, err := netip.ParseAddr(host.IP)
+			if err != nil {
+				return err
+			}
+			carried := false
+			for i := range desired.IPs {
+				prefix, err := NetworkIPPrefix(desired.IPs[i])
+				if err != nil {
+					return err
+				} else if desired.IPs[i].DHCP != nil && checkDomainIP(prefix, addr) == nil {
+					desired.IPs[i].DHCP.Hosts = append(desired.IPs[i].DHCP.Hosts, host)
+					carried = true
+					break
+				}
+			}
+			if !carried {
+				log.Printf("WARN: dropping ip reservation %s (%s) outside of the new ranges", host.IP, host.Name)
+			}
+		}
+	}
+	if current.DNS != nil && desired.DNS != nil {
+		desired.DNS.Host = current.DNS.Host
+	}
+	return nil
+}
+
+// applyNetwork diffs the desired network against the running one. Changes libvirt can update live are applied
+// in place, a restart (which disconnects the domains) is only done for the other changes after confirmation.
+// restarted reports whether the network was restarted.
+func (c *Config) applyNetwork(yes bool) (restarted bool, err error) {
+	if c.net == nil {
+		return false, c.initNetwork()
+	}
+	log.Printf("checking net %q for changes...", c.Net)
+	desired, err := c.NetworkXML()
+	if err != nil {
+		return false, err
+	}
+	current, err := GetNetworkDef(c.net)
+	if err != nil {
+		return false, err
+	}
+	if c.GetNetMode() != netModeBridge {
+		if err := updateNetworkLive(c.net, current, desired); err != nil {
+			return false, err
+		}
+	}
+	changes, err := networkRestartChanges(current, desired)
+	if err != nil {
+		return false, err
+	} else if len(changes) == 0 {
+		log.Printf("net %q is up to date", c.Net)
+		return false, nil
+	}
+	for _, change := range changes {
+		log.Printf("net %q needs a restart for: %s", c.Net, change)
+	}
+	if !yes && !confirm(fmt.Sprintf("restart net %q? domains on it lose connectivity until they are restarted", c.Net)) {
+		log.Printf("kept net %q running, changes not applied", c.Net)
+		return false, nil
+	}
+	// keep the live record changes from above
+	if current, err = GetNetworkDef(c.net); err != nil {
+		return false, err
+	} else if err := carryNetworkHosts(current, desired); err != nil {
+		return false, err
+	}
+	desired.UUID = current.UUID
+	netXML, err := desired.Marshal()
+	if err != nil {
+		return false, err
+	}
+	if c.Verbose {
+		fmt.Println(netXML)
+	}
+	log.Printf("restarting net %q...", c.Net)
+	net, err := c.conn.NetworkDefineXML(netXML)
+	if err != nil {
+		return false, err
+	}
+	net.Free()
+	if err := c.net.Destroy(); err != nil {
+		return false, err
+	} else if err := c.net.Create(); err != nil {
+		return true, err
+	}
+	log.Printf("restarted net %q", c.Net)
+	return true, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
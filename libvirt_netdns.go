@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+type (
+	DNSForwarder struct {
+		Addr   string // nameserver IP, empty with Domain to answer the domain from the network only
+		Domain string // forward only queries for this domain (default all)
+	}
+	DNSSRV struct {
+		Service  string // service name, i.e. ldap
+		Protocol string // tcp or udp
+		Domain   string // domain (default the network domain)
+		Target   string // target hostname
+		Port     uint
+		Priority uint
+		Weight   uint
+	}
+)
+
+// NetworkDNSForwardersXML are NetDNS and NetDNSForwarders
+func (c *Config) NetworkDNSForwardersXML() []libvirtxml.NetworkDNSForwarder {
+	forwarders := []libvirtxml.NetworkDNSForwarder{}
+	if c.NetDNS != "" {
+		forwarders = append(forwarders, libvirtxml.NetworkDNSForwarder{Addr: c.NetDNS})
+	}
+	for _, f := range c.NetDNSForwarders {
+		forwarders = append(forwarders, libvirtxml.NetworkDNSForwarder{Addr: f.Addr, Domain: f.Domain})
+	}
+	return forwarders
+}
+
+func (c *Config) NetworkDNSTXTsXML() []libvirtxml.NetworkDNSTXT {
+	txts := []libvirtxml.NetworkDNSTXT{}
+	for name, value := range c.NetDNSTXT {
+		txts = append(txts, libvirtxml.NetworkDNSTXT{Name: name, Value: value})
+	}
+	sort.Slice(txts, func(i, j int) bool {
+		return txts[i].Name < txts[j].Name
+	})
+	return txts
+}
+
+func (c *Config) NetworkDNSSRVsXML() []libvirtxml.NetworkDNSSRV {
+	srvs := []libvirtxml.NetworkDNSSRV{}
+	for _, s := range c.NetDNSSRV {
+		srvs = append(srvs, libvirtxml.NetworkDNSSRV{
+			Service:  s.Service,
+			Protocol: s.Protocol,
+			Domain:   s.Domain,
+			Target:   s.Target,
+			Port:     s.Port,
+			Priority: s.Priority,
+			Weight:   s.Weight,
+		})
+	}
+	return srvs
+}
+
+// NetworkDomainXML is the network <domain> for NetDomain, nil without one
+func (c *Config) NetworkDomainXML() *libvirtxml.NetworkDomain {
+	if c.NetDomain == "" {
+		return nil
+	}
+	domain := &libvirtxml.NetworkDomain{Name: c.NetDomain}
+	if c.NetDomainLocalOnly {
+		domain.LocalOnly = "yes"
+	}
+	return domain
+}
+
+// updateDNSRecords deletes the current records missing from desired and adds the desired records missing from current,
+// records are compared by their xml
+func updateDNSRecords(net *libvirt.Network, section libvirt.NetworkUpdateSection, current, desired []string) error {
+	for _, record := range current {
+		if !containsString(desired, record) {
+			log.Printf("deleting dns record %s", record)
+			if err := net.Update(libvirt.NETWORK_UPDATE_COMMAND_DELETE, section, -1, record, networkUpdateFlags(net)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, record := range desired {
+		if !containsString(current, record) {
+			log.Printf("adding dns record %s", record)
+			if err := net.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, section, -1, record, networkUpdateFlags(net)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func marshalDNSTXTs(txts []libvirtxml.NetworkDNSTXT) ([]string, error) {
+	records := []string{}
+	for _, txt := range txts {
+		record, err := txt.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func marshalDNSSRVs(srvs []libvirtxml.NetworkDNSSRV) ([]string, error) {
+	records := []string{}
+	for _, srv := range srvs {
+		record, err := srv.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// syncNetworkDNS brings the network's domain, forwarders, SRV and TXT records in line with the config.
+// Records are updated live, libvirt has no live update for the domain and forwarders so they change
+// the persistent definition and apply when the network restarts.
+func (c *Config) syncNetworkDNS() error {
+	log.Printf("checking dns records of net %q...", c.Net)
+	if c.net == nil {
+		return fmt.Errorf("net %q does not exist", c.Net)
+	} else if c.GetNetMode() == netModeBridge {
+		return nil
+	}
+	netDef, err := GetNetworkDef(c.net)
+	if err != nil {
+		return err
+	}
+	current := netDef.DNS
+	if current == nil {
+		current = &libvirtxml.NetworkDNS{}
+	}
+	if currentTXTs, err := marshalDNSTXTs(current.TXTs); err != nil {
+		return err
+	} else if desiredTXTs, err := marshalDNSTXTs(c.NetworkDNSTXTsXML()); err != nil {
+		return err
+	} else if err := updateDNSRecords(c.net, libvirt.NETWORK_SECTION_DNS_TXT, currentTXTs, desiredTXTs); err != nil {
+		return err
+	}
+	if currentSRVs, err := marshalDNSSRVs(current.SRVs); err != nil {
+		return err
+	} else if desiredSRVs, err := marshalDNSSRVs(c.NetworkDNSSRVsXML()); err != nil {
+		return err
+	} else if err := updateDNSRecords(c.net, libvirt.NETWORK_SECTION_DNS_SRV, currentSRVs, desiredSRVs); err != nil {
+		return err
+	}
+
+	// compare with the persistent definition, it may already be updated and waiting for a restart
+	netXML, err := c.net.GetXMLDesc(libvirt.NETWORK_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+	inactive := &libvirtxml.Network{}
+	if err := inactive.Unmarshal(netXML); err != nil {
+		return err
+	}
+	if inactive.DNS == nil {
+		inactive.DNS = &libvirtxml.NetworkDNS{}
+	}
+	domain, forwarders := c.NetworkDomainXML(), c.NetworkDNSForwardersXML()
+	sameDomain := (domain == nil && inactive.Domain == nil) || (domain != nil && inactive.Domain != nil && *domain == *inactive.Domain)
+	sameForwarders := len(forwarders) == len(inactive.DNS.Forwarders)
+	for i := 0; sameForwarders && i < len(forwarders); i++ {
+		sameForwarders = forwarders[i] == inactive.DNS.Forwarders[i]
+	}
+	if sameDomain && sameForwarders {
+		return nil
+	}
+	inactive.Domain, inactive.DNS.Forwarders = domain, forwarders
+	if netXML, err = inactive.Marshal(); err != nil {
+		return err
+	}
+	log.Printf("updating dns domain and forwarders of net %q", c.Net)
+	net, err := c.conn.NetworkDefineXML(netXML)
+	if err != nil {
+		return err
+	}
+	net.Free()
+	log.Printf("WARN: net %q dns domain and forwarders apply after the network restarts", c.Net)
+	return nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	poolTypeDir     = "dir"
+	poolTypeFs      = "fs"
+	poolTypeNetfs   = "netfs"
+	poolTypeLogical = "logical"
+	poolTypeZfs     = "zfs"
+	mib             = 1024 * 1024
+)
+
+type poolVolume struct {
+	Name       string
+	Path       string
+	Capacity   uint64
+	Allocation uint64
+	Modified   time.Time // zero when the pool doesn't report timestamps
+	Domains    []string  // domains with a disk referencing the volume
+	Backing    bool      // backing store of another volume in the pool
+
+	backingPath string
+}
+
+func newPoolVolume(vol *libvirt.StorageVol) (*poolVolume, error) {
+	pv := &poolVolume{Domains: []string{}}
+	var err error
+	if pv.Name, err = vol.GetName(); err != nil {
+		return nil, err
+	} else if pv.Path, err = vol.GetPath(); err != nil {
+		return nil, err
+	}
+	info, err := vol.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	pv.Capacity, pv.Allocation = info.Capacity, info.Allocation
+	volXML, err := vol.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	volDef := &libvirtxml.StorageVolume{}
+	if err := volDef.Unmarshal(volXML); err != nil {
+		return nil, err
+	}
+	if volDef.BackingStore != nil {
+		pv.backingPath = volDef.BackingStore.Path
+	}
+	if volDef.Target != nil && volDef.Target.Timestamps != nil && volDef.Target.Timestamps.Mtime != "" {
+		// timestamps are formatted as "seconds.nanoseconds"
+		if secs, err := strconv.ParseFloat(volDef.Target.Timestamps.Mtime, 64); err == nil {
+			pv.Modified = time.Unix(int64(secs), 0)
+		}
+	}
+	return pv, nil
+}
+
+func (v *poolVolume) IsBase(c *Config) bool {
+	return v.Backing || (c.BaseDisk != "" && v.Name == filepath.Base(c.BaseDisk))
+}
+
+func (v *poolVolume) IsOrphan(c *Config) bool {
+	return len(v.Domains) == 0 && !v.IsBase(c)
+}
+
+// matchesVolume is true when name matches one of the path.Match patterns
+func matchesVolume(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) GetPoolType() string {
+	if c.PoolType == "" {
+		return poolTypeDir
+	}
+	return c.PoolType
+}
+
+// IsFilePool is true for pool types whose volumes are files in a directory
+func (c *Config) IsFilePool() bool {
+	switch c.GetPoolType() {
+	case poolTypeDir, poolTypeFs, poolTypeNetfs:
+		return true
+	}
+	return false
+}
+
+func (c *Config) GetDiskFormat() string {
+	if c.DiskFormat != "" {
+		return c.DiskFormat
+	} else if c.IsFilePool() {
+		return "qcow2"
+	}
+	return "raw"
+}
+
+func (c *Config) GetPoolSourceName() string {
+	if c.PoolSourceName == "" {
+		return c.Pool
+	}
+	return c.PoolSourceName
+}
+
+func (c *Config) StorageVolumeTarget() *libvirtxml.StorageVolumeTarget {
+	if !c.IsFilePool() {
+		// block based pools have no volume formats
+		return nil
+	}
+	return &libvirtxml.StorageVolumeTarget{
+		Format: &libvirtxml.StorageVolumeTargetFormat{
+			Type: c.GetDiskFormat(),
+		},
+	}
+}
+
+func (c *Config) StoragePoolXML() (*libvirtxml.StoragePool, error) {
+	pool := &libvirtxml.StoragePool{
+		Type:   c.GetPoolType(),
+		Name:   c.Pool,
+		Source: &libvirtxml.StoragePoolSource{},
+	}
+	for _, device := range c.PoolSourceDevices {
+		pool.Source.Device = append(pool.Source.Device, libvirtxml.StoragePoolSourceDevice{Path: device})
+	}
+	if c.PoolSourceFormat != "" {
+		pool.Source.Format = &libvirtxml.StoragePoolSourceFormat{Type: c.PoolSourceFormat}
+	}
+	switch c.GetPoolType() {
+	case poolTypeDir:
+	case poolTypeFs:
+		if len(c.PoolSourceDevices) != 1 {
+			return nil, fmt.Errorf("pool type %q requires exactly one PoolSourceDevices entry", poolTypeFs)
+		} else if pool.Source.Format == nil {
+			pool.Source.Format = &libvirtxml.StoragePoolSourceFormat{Type: "auto"}
+		}
+	case poolTypeNetfs:
+		if c.PoolSourceHost == "" || c.PoolSourceDir == "" {
+			return nil, fmt.Errorf("pool type %q requires PoolSourceHost and PoolSourceDir", poolTypeNetfs)
+		}
+		pool.Source.Host = []libvirtxml.StoragePoolSourceHost{{Name: c.PoolSourceHost}}
+		pool.Source.Dir = &libvirtxml.StoragePoolSourceDir{Path: c.PoolSourceDir}
+		if pool.Source.Format == nil {
+			pool.Source.Format = &libvirtxml.StoragePoolSourceFormat{Type: "nfs"}
+		}
+	case poolTypeLogical:
+		pool.Source.Name = c.GetPoolSourceName()
+		if pool.Source.Format == nil {
+			pool.Source.Format = &libvirtxml.StoragePoolSourceFormat{Type: "lvm2"}
+		}
+	case poolTypeZfs:
+		pool.Source.Name = c.GetPoolSourceName()
+	default:
+		return nil, fmt.Errorf("pool type %q is not supported (use dir, fs, netfs, logical or zfs)", c.PoolType)
+	}
+	if c.IsFilePool() {
+		if c.PoolPath == "" {
+			return nil, fmt.Errorf("pool type %q requires PoolPath", c.GetPoolType())
+		}
+		pool.Target = &libvirtxml.StoragePoolTarget{
+			Path: c.PoolPath,
+			Permissions: &libvirtxml.StoragePoolTargetPermissions{
+				Mode: "0755",
+			},
+		}
+	} else if c.PoolPath != "" {
+		pool.Target = &libvirtxml.StoragePoolTarget{Path: c.PoolPath}
+	}
+	return pool, nil
+}
+
+// checkPoolSpace fails when the pool can't fit required bytes while keeping PoolReserve percent free
+func (c *Config) checkPoolSpace(what string, required uint64) error {
+	if c.pool == nil {
+		return fmt.Errorf("pool %q not loaded", c.Pool)
+	}
+	if err := c.pool.Refresh(0); err != nil {
+		return err
+	}
+	info, err := c.pool.GetInfo()
+	if err != nil {
+		return err
+	}
+	reserve := info.Capacity * uint64(c.PoolReserve) / 100
+	if info.Available < reserve || info.Available-reserve < required {
+		return fmt.Errorf("pool %q has %d MiB available (%d%% reserve is %d MiB), %s needs %d MiB",
+			c.Pool, info.Available/mib, c.PoolReserve, reserve/mib, what, required/mib)
+	}
+	if c.Verbose {
+		log.Printf("pool %q has %d MiB available, %s needs %d MiB", c.Pool, info.Available/mib, what, required/mib)
+	}
+	return nil
+}
+
+// listPoolVolumes lists the pool's volumes and the defined domains using them
+func (c *Config) listPoolVolumes() ([]*poolVolume, error) {
+	if c.pool == nil {
+		return nil, fmt.Errorf("pool %q not loaded", c.Pool)
+	}
+	if err := c.pool.Refresh(0); err != nil {
+		return nil, err
+	}
+	vols, err := c.pool.ListAllStorageVolumes(0)
+	if err != nil {
+		return nil, err
+	}
+	poolVols := []*poolVolume{}
+	byName := map[string]*poolVolume{}
+	byPath := map[string]*poolVolume{}
+	for _, vol := range vols {
+		pv, err := newPoolVolume(&vol)
+		vol.Free()
+		if err != nil {
+			return nil, err
+		}
+		poolVols = append(poolVols, pv)
+		byName[pv.Name] = pv
+		byPath[pv.Path] = pv
+	}
+	for _, pv := range poolVols {
+		if backing, ok := byPath[pv.backingPath]; ok {
+			backing.Backing = true
+		}
+	}
+	doms, err := c.conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, dom := range doms {
+		domName, _ := dom.GetName()
+		domXML, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+		dom.Free()
+		if err != nil {
+			return nil, err
+		}
+		domDef := &libvirtxml.Domain{}
+		if err := domDef.Unmarshal(domXML); err != nil {
+			return nil, err
+		} else if domDef.Devices == nil {
+			continue
+		}
+		for _, disk := range domDef.Devices.Disks {
+			var pv *poolVolume
+			switch {
+			case disk.Source == nil:
+			case disk.Source.Volume != nil && disk.Source.Volume.Pool == c.Pool:
+				pv = byName[disk.Source.Volume.Volume]
+			case disk.Source.File != nil:
+				pv = byPath[disk.Source.File.File]
+			case disk.Source.Block != nil:
+				pv = byPath[disk.Source.Block.Dev]
+			}
+			if pv != nil {
+				pv.Domains = append(pv.Domains, domName)
+			}
+		}
+	}
+	sort.Slice(poolVols, func(i, j int) bool { return poolVols[i].Name < poolVols[j].Name })
+	return poolVols, nil
+}
+
+func (c *Config) reportPoolUsage(w io.Writer) error {
+	log.Printf("checking usage of pool %q...", c.Pool)
+	poolVols, err := c.listPoolVolumes()
+	if err != nil {
+		return err
+	}
+	info, err := c.pool.GetInfo()
+	if err != nil {
+		return err
+	}
+	byDomain := map[string][]*poolVolume{}
+	domains := []string{}
+	for _, pv := range poolVols {
+		owners := pv.Domains
+		if len(owners) == 0 {
+			if pv.IsBase(c) {
+				owners = []string{"(base)"}
+			} else {
+				owners = []string{"(unused)"}
+			}
+		}
+		for _, owner := range owners {
+			if _, ok := byDomain[owner]; !ok {
+				domains = append(domains, owner)
+			}
+			byDomain[owner] = append(byDomain[owner], pv)
+		}
+	}
+	sort.Strings(domains)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tVOLUMES\tCAPACITY MiB\tALLOCATION MiB\tPOOL %")
+	for _, domain := range domains {
+		names := []string{}
+		capacity, allocation := uint64(0), uint64(0)
+		for _, pv := range byDomain[domain] {
+			names = append(names, pv.Name)
+			capacity += pv.Capacity
+			allocation += pv.Allocation
+		}
+		percent := 0.0
+		if info.Capacity > 0 {
+			percent = float64(allocation) / float64(info.Capacity) * 100
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%1.2f\n", domain, strings.Join(names, ","), capacity/mib, allocation/mib, percent)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	reserve := info.Capacity * uint64(c.PoolReserve) / 100
+	fmt.Fprintf(w, "\npool %q: capacity %d MiB, allocation %d MiB, available %d MiB, reserve %d MiB\n",
+		c.Pool, info.Capacity/mib, info.Allocation/mib, info.Available/mib, reserve/mib)
+	return nil
+}
+
+// gcPoolVols reports the volumes not used by any domain (and not the base volume) with their sizes, and deletes
+// the ones matching patterns after confirmation. Without patterns, volumes of the -n domains (a glob) are matched.
+// Unmatched volumes are reported as kept, they may be the base image of another config, as are volumes modified
+// less than minAge ago.
+func (c *Config) gcPoolVols(minAge time.Duration, yes bool, patterns []string) error {
+	log.Printf("checking pool %q for orphaned volumes...", c.Pool)
+	if len(patterns) == 0 && c.Name != "" {
+		patterns = []string{c.Disk()}
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("volume pattern %q: %w", pattern, err)
+		}
+	}
+	poolVols, err := c.listPoolVolumes()
+	if err != nil {
+		return err
+	}
+	// every orphan is listed, kept ones with the reason
+	orphans, deletes := []*poolVolume{}, []*poolVolume{}
+	kept := map[string]string{}
+	for _, pv := range poolVols {
+		if !pv.IsOrphan(c) {
+			continue
+		}
+		orphans = append(orphans, pv)
+		if !matchesVolume(patterns, pv.Name) {
+			kept[pv.Name] = "keep, possible base image"
+		} else if minAge > 0 && pv.Modified.IsZero() {
+			kept[pv.Name] = "keep, unknown age"
+		} else if minAge > 0 && time.Since(pv.Modified) < minAge {
+			kept[pv.Name] = "keep, newer than " + minAge.String()
+		} else {
+			deletes = append(deletes, pv)
+		}
+	}
+	if len(orphans) == 0 {
+		log.Printf("no orphaned volumes in pool %q", c.Pool)
+		return nil
+	}
+	allocation := uint64(0)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VOLUME\tCAPACITY MiB\tALLOCATION MiB\tMODIFIED\tACTION")
+	for _, pv := range orphans {
+		modified := "-"
+		if !pv.Modified.IsZero() {
+			modified = pv.Modified.Format(time.RFC3339)
+		}
+		action, ok := kept[pv.Name]
+		if !ok {
+			action = "delete"
+			allocation += pv.Allocation
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", pv.Name, pv.Capacity/mib, pv.Allocation/mib, modified, action)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(deletes) == 0 {
+		log.Printf("no orphaned volumes to delete in pool %q (i.e. gc 'old-*.img', or -n 'old-*' for its domain volumes)", c.Pool)
+		return nil
+	} else if !yes && !confirm(fmt.Sprintf("delete %d orphaned volume(s) from pool %q, freeing %d MiB?", len(deletes), c.Pool, allocation/mib)) {
+		log.Printf("kept orphaned volumes")
+		return nil
+	}
+	var errs error
+	for _, pv := range deletes {
+		vol, err := c.pool.LookupStorageVolByName(pv.Name)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		if err := deleteStorageVol(pv.Name, vol); err != nil {
+			errs = errors.Join(errs, err)
+		}
+		vol.Free()
+	}
+	return errs
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// TestPoolTestDriver defines pools against libvirt's in-memory test driver and checks the domain disk
+// references the volume by pool, so it works for file and block based pools alike
+func TestPoolTestDriver(t *testing.T) {
+	conn, err := libvirt.NewConnect("test:///default")
+	if err != nil {
+		t.Skipf("libvirt test driver: %v", err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name       string
+		config     Config
+		sourceName string
+		format     string
+	}{
+		{
+			name:   "dir",
+			config: Config{Pool: "lvdev-dir", PoolPath: "/var/lib/lvdev-dir"},
+			format: "qcow2",
+		},
+		{
+			name:       "logical",
+			config:     Config{Pool: "lvdev-lvm", PoolType: poolTypeLogical, PoolSourceName: "vg0"},
+			sourceName: "vg0",
+			format:     "raw",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			c.conn = conn
+			if err := c.initPool(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				c.pool.Destroy()
+				c.pool.Undefine()
+				c.pool.Free()
+			}()
+			poolXML, err := c.pool.GetXMLDesc(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool := &libvirtxml.StoragePool{}
+			if err := pool.Unmarshal(poolXML); err != nil {
+				t.Fatal(err)
+			}
+			if pool.Type != tt.name {
+				t.Errorf("pool type = %q, want %q", pool.Type, tt.name)
+			}
+			if tt.sourceName != "" && (pool.Source == nil || pool.Source.Name != tt.sourceName) {
+				t.Errorf("pool source = %+v, want name %q", pool.Source, tt.sourceName)
+			}
+
+			dom := &libvirtxml.Domain{Devices: &libvirtxml.DomainDeviceList{}}
+			ConfigureDomainXML(dom, "vm", 1, 512, c.Pool, "vm.img", c.GetDiskFormat(), nil, nil)
+			domXML, err := dom.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed := &libvirtxml.Domain{}
+			if err := parsed.Unmarshal(domXML); err != nil {
+				t.Fatal(err)
+			}
+			disk := parsed.Devices.Disks[0]
+			if disk.Source == nil || disk.Source.Volume == nil {
+				t.Fatalf("disk source = %+v, want <source pool= volume=>", disk.Source)
+			} else if disk.Source.Volume.Pool != c.Pool || disk.Source.Volume.Volume != "vm.img" {
+				t.Errorf("disk source volume = %+v, want pool %q volume %q", disk.Source.Volume, c.Pool, "vm.img")
+			}
+			if disk.Driver == nil || disk.Driver.Type != tt.format {
+				t.Errorf("disk driver = %+v, want type %q", disk.Driver, tt.format)
+			}
+		})
+	}
+}
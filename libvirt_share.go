@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+const (
+	shareDriverVirtiofs = "virtiofs"
+	shareDriver9p       = "9p"
+)
+
+type Share struct {
+	Source   string // hypervisor directory to share
+	Tag      string // guest mount tag
+	Mount    string // guest mount point (default /mnt/<Tag>)
+	Driver   string // virtiofs (default) or 9p
+	ReadOnly bool   // mount read-only
+}
+
+func (s Share) GetDriver() string {
+	if s.Driver == "" {
+		return shareDriverVirtiofs
+	}
+	return s.Driver
+}
+
+func (s Share) GetMount() string {
+	if s.Mount == "" {
+		return path.Join("/mnt", s.Tag)
+	}
+	return s.Mount
+}
+
+func (s Share) Validate() error {
+	if s.Source == "" || s.Tag == "" {
+		return fmt.Errorf("share %q requires Source and Tag", s.Tag)
+	} else if d := s.GetDriver(); d != shareDriverVirtiofs && d != shareDriver9p {
+		return fmt.Errorf("share %q driver %q is not supported (use virtiofs or 9p)", s.Tag, d)
+	} else if !path.IsAbs(s.GetMount()) {
+		return fmt.Errorf("share %q mount %q must be an absolute path", s.Tag, s.GetMount())
+	}
+	return nil
+}
+
+func (s Share) mountOptions() string {
+	opts := []string{}
+	if s.GetDriver() == shareDriver9p {
+		opts = append(opts, "trans=virtio", "version=9p2000.L")
+	}
+	if s.ReadOnly {
+		opts = append(opts, "ro")
+	} else {
+		opts = append(opts, "rw")
+	}
+	return strings.Join(opts, ",")
+}
+
+func (s Share) MountArgs() []string {
+	return []string{"-t", s.GetDriver(), "-o", s.mountOptions(), s.Tag, s.GetMount()}
+}
+
+func (s Share) FstabEntry() string {
+	return strings.Join([]string{s.Tag, s.GetMount(), s.GetDriver(), s.mountOptions() + ",nofail", "0", "0"}, " ")
+}
+
+// hasMountEntry checks an fstab or /proc/mounts formatted table for the share
+func (s Share) hasMountEntry(table []byte) bool {
+	for _, line := range strings.Split(string(table), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == s.Tag && path.Clean(fields[1]) == path.Clean(s.GetMount()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) initShares() error {
+	if len(c.Shares) == 0 {
+		return nil
+	}
+	mounts, err := ReadGuestFile(c.dom, "/proc/mounts")
+	if err != nil {
+		return err
+	}
+	fstab, err := ReadGuestFile(c.dom, "/etc/fstab")
+	if err != nil {
+		return err
+	}
+	fstabAppend := ""
+	for _, share := range c.Shares {
+		if share.hasMountEntry(mounts) {
+			log.Printf("share %q already mounted at %q for %q", share.Tag, share.GetMount(), c.Name)
+		} else {
+			log.Printf("mounting share %q at %q for %q", share.Tag, share.GetMount(), c.Name)
+			if _, err := ExecuteGuestCommand(c.dom, waitInterval, "mkdir", "-p", share.GetMount()); err != nil {
+				return err
+			} else if _, err := ExecuteGuestCommand(c.dom, waitInterval, "mount", share.MountArgs()...); err != nil {
+				return err
+			}
+		}
+		if !share.hasMountEntry(fstab) {
+			fstabAppend += share.FstabEntry() + "\n"
+		}
+	}
+	if fstabAppend != "" {
+		if len(fstab) > 0 && !strings.HasSuffix(string(fstab), "\n") {
+			fstabAppend = "\n" + fstabAppend
+		}
+		log.Printf("persisting shares in /etc/fstab for %q", c.Name)
+		if err := WriteGuestFile(c.dom, "/etc/fstab", "a", []byte(fstabAppend)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
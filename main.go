@@ -1,17 +1,99 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
+type commandOptions struct {
+	yes        bool          // skip confirmation prompts
+	age        time.Duration // minimum age of volumes to garbage collect
+	background bool          // run forwards in the background
+	configfile string        // config file, for background processes
+	labels     string        // label selector for run and rsync (key=value,...)
+	parallel   int           // maximum domains run at once
+}
+
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// parseCommandArgs collects the command words following the global flags. Flags may be
+// interleaved with command words, and anything after "--" is returned as passthrough args.
+func parseCommandArgs() (args, passthrough []string) {
+	args = []string{}
+	for flag.NArg() > 0 {
+		rest := flag.Args()[1:]
+		args = append(args, flag.Arg(0))
+		if err := flag.CommandLine.Parse(rest); err != nil {
+			log.Fatal(err)
+		}
+		if n := len(rest) - flag.NArg(); n > 0 && rest[n-1] == "--" {
+			return args, flag.Args()
+		}
+	}
+	return args, []string{}
+}
+
+func runCommand(ctx context.Context, c *Config, opts *commandOptions, args, passthrough []string) error {
+	switch strings.Join(args, " ") {
+	case "pool usage":
+		return c.reportPoolUsage(os.Stdout)
+	case "hosts sync":
+		return c.syncHosts(ctx)
+	case "dns serve":
+		return c.serveDNS(ctx)
+	case "ssh-config":
+		return c.writeSSHConfig()
+	case "forward list":
+		return reportForwards(os.Stdout)
+	case "forward stop":
+		return stopForwards(c.Name)
+	case "up":
+		return c.up(opts.configfile)
+	case "run":
+		return c.runDomains(ctx, opts.labels, opts.parallel, passthrough)
+	case "net apply":
+		if restarted, err := c.applyNetwork(opts.yes); err != nil {
+			return err
+		} else if restarted {
+			log.Printf("WARN: restart the domains on net %q to reconnect them (-restartalldoms)", c.Net)
+		}
+		return nil
+	}
+	if args[0] == "gc" {
+		return c.gcPoolVols(opts.age, opts.yes, args[1:])
+	}
+	if args[0] == "rsync" && len(args) == 2 {
+		return c.rsyncDomains(ctx, opts.labels, opts.parallel, args[1])
+	}
+	if args[0] == "forward" {
+		if c.Name == "" {
+			return errors.New("forward requires a domain name (-n)")
+		} else if opts.background {
+			return startForward(opts.configfile, c.Name, args[1:])
+		}
+		return c.forwardDomain(ctx, args[1:])
+	}
+	return fmt.Errorf("unknown command %q", strings.Join(append(args, passthrough...), " "))
+}
+
 func main() {
 	var (
 		c                             = Config{}
+		opts                          = commandOptions{}
 		addAll, delAll                bool
 		addDom, delDom                bool
 		addNet, delNet                bool
@@ -20,8 +102,11 @@ func main() {
 		addDomVol, delDomVol          bool
 		addRoutes, delRoutes          bool
 		syncDNS, restartAllDoms       bool
-		syncConf, rsync               string
+		syncConfDiff                  bool
+		syncConf, rsync, rsyncPull    string
+		rsyncWatch                    bool
 		configfile, sshSubsystem      string
+		syncConfRoot                  string
 	)
 	flag.BoolVar(&addAll, "addall", false, "Create storage, network, and domain")
 	flag.BoolVar(&delAll, "delall", false, "Delete all storage, network, and domain")
@@ -39,18 +124,42 @@ func main() {
 	flag.BoolVar(&addRoutes, "addroutes", false, "Add routes")
 	flag.BoolVar(&delRoutes, "delroutes", false, "Del routes")
 	flag.BoolVar(&syncDNS, "syncdns", false, "Sync DNS between domains and network")
-	flag.BoolVar(&restartAllDoms, "restartalldoms", false, "Destroy/create all domains")
+	flag.BoolVar(&restartAllDoms, "restartalldoms", false, "Apply network changes and destroy/create all domains")
 
 	flag.BoolVar(&c.Verbose, "v", false, "Verbose output")
+	flag.BoolVar(&c.PreferIPv6, "6", false, "Prefer IPv6 domain addresses for ssh and rsync")
 	flag.StringVar(&syncConf, "syncconf", "", "Sync config to domain")
+	flag.BoolVar(&syncConfDiff, "syncconf-diff", false, "Show what -syncconf would change on the domain, without applying it")
+	flag.StringVar(&syncConfRoot, "syncconf-root", "/", "Root dir syncconf-receive applies the config to")
 	flag.StringVar(&rsync, "rsync", "", "Execute sync command from local dir to remote host (see config RemoteDir)")
+	flag.StringVar(&rsyncPull, "rsync-pull", "", "Execute sync command from remote host (see config RemoteDir) to local dir")
+	flag.BoolVar(&rsyncWatch, "rsync-watch", false, "Watch the -rsync local dir and sync again on changes")
 	flag.StringVar(&c.Name, "n", "", "Libvirt domain name (VM name)")
 	flag.StringVar(&sshSubsystem, "ssh", "", "SSH subsystem to invoke (may require sshd_config customization)")
 	flag.StringVar(&configfile, "c", "", "Config file")
+	flag.BoolVar(&opts.yes, "yes", false, "Assume yes for confirmation prompts")
+	flag.BoolVar(&opts.background, "bg", false, "Run forward tunnels in the background (see forward list and stop)")
+	flag.StringVar(&opts.labels, "l", "", "Domain labels to select domains for run and rsync (key=value,...)")
+	flag.IntVar(&opts.parallel, "p", defaultParallel, "Maximum domains to run on at once")
+	flag.DurationVar(&opts.age, "age", 0, "Minimum age of orphaned volumes deleted by gc (i.e. 24h)")
 	flag.Parse()
+	command, passthrough := parseCommandArgs()
+	opts.configfile = configfile
 
 	log.SetFlags(log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	// runs on the domain as the sshd subsystems, without a config or libvirt connection
+	if receiver := strings.Join(command, " "); receiver == "syncconf-receive" || receiver == "syncconf-diff" {
+		if err := receiveConfig(os.Stdin, os.Stdout, syncConfRoot, receiver == "syncconf-diff"); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if strings.Join(command, " ") == "dns serve" {
+		if err := initEventLoop(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	err := LoadConfig(&c, configfile)
 	if err != nil {
 		log.Fatal(err)
@@ -137,22 +246,45 @@ func main() {
 			log.Println(err)
 		}
 	} else if restartAllDoms {
-		if err := c.restartAllDomains(); err != nil {
+		if err := c.restartAllDomains(opts.yes); err != nil {
 			log.Println(err)
 		}
 	} else if syncDNS {
+		if err := c.syncNetworkDNS(); err != nil {
+			log.Println(err)
+		}
 		if err := c.syncDomainNamesToNetworkDNS(); err != nil {
 			log.Println(err)
 		}
+	} else if len(command) > 0 {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := runCommand(ctx, &c, &opts, command, passthrough)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		go func() {
-			if rsync != "" {
-				if err := doRsync(ctx, &c, rsync); err != nil {
+			if rsync != "" && rsyncWatch {
+				if err := watchRsync(ctx, &c, rsync); err != nil {
+					log.Println(err)
+				}
+			} else if rsync != "" {
+				if err := doRsync(ctx, &c, rsync, false); err != nil {
+					log.Println(err)
+				}
+			} else if rsyncPull != "" {
+				if err := doRsync(ctx, &c, rsyncPull, true); err != nil {
 					log.Println(err)
 				}
 			} else if syncConf != "" {
-				if err := doConfigure(ctx, &c, "syncconf", syncConf); err != nil {
+				// a separate subsystem, a receiver that doesn't know diffs fails instead of applying
+				subsystem := "syncconf"
+				if syncConfDiff {
+					subsystem = "syncconf-diff"
+				}
+				if err := doConfigure(ctx, &c, subsystem, syncConf); err != nil {
 					log.Println(err)
 				}
 			} else {
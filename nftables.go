@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type portForward struct {
+	HostPort uint16
+	Proto    string
+	Domain   string
+	Port     uint16
+}
+
+const (
+	libvirtNftChain      = "ip libvirt_network guest_input" // libvirt's nftables backend reject for nat networks
+	libvirtIptablesChain = "LIBVIRT_FWI"                    // libvirt's iptables backend reject for nat networks
+)
+
+var nftInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// ParsePortForwards parses "hostport[/proto]": "domain:port" forwards
+func ParsePortForwards(forwards map[string]string) ([]portForward, error) {
+	pfs := []portForward{}
+	for hostPort, target := range forwards {
+		pf := portForward{Proto: "tcp"}
+		if port, proto, ok := strings.Cut(hostPort, "/"); ok {
+			hostPort, pf.Proto = port, proto
+		}
+		if pf.Proto != "tcp" && pf.Proto != "udp" {
+			return nil, fmt.Errorf("port forward %q protocol must be tcp or udp", hostPort)
+		}
+		domain, port, ok := strings.Cut(target, ":")
+		if !ok || domain == "" {
+			return nil, fmt.Errorf("port forward %q target %q must be domain:port", hostPort, target)
+		}
+		pf.Domain = domain
+		if n, err := strconv.ParseUint(hostPort, 10, 16); err != nil {
+			return nil, fmt.Errorf("port forward %q: %w", hostPort, err)
+		} else {
+			pf.HostPort = uint16(n)
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("port forward %q: %w", target, err)
+		} else {
+			pf.Port = uint16(n)
+		}
+		pfs = append(pfs, pf)
+	}
+	sort.Slice(pfs, func(i, j int) bool {
+		if pfs[i].HostPort == pfs[j].HostPort {
+			return pfs[i].Proto < pfs[j].Proto
+		}
+		return pfs[i].HostPort < pfs[j].HostPort
+	})
+	return pfs, nil
+}
+
+// nftTableName is the hypervisor nftables table holding a domain's port forwards
+func nftTableName(domName string) string {
+	return "lvdev_" + nftInvalidChars.ReplaceAllString(domName, "_")
+}
+
+// PortForwardsScript is a sh script replacing the domain's nftables table with its forwards, or only deleting
+// it when there are no forwards. Libvirt rejects new connections into nat networks in its own chains, which
+// an accept in another table can't override, so the forwarded ports are also accepted in libvirt's chain:
+// guest_input with the nftables backend (libvirt 10.4+), LIBVIRT_FWI with iptables. Those rules are tagged
+// with the table name to replace them, and are lost when libvirt reloads its rules (network restart).
+func PortForwardsScript(domName, addr string, forwards []portForward) string {
+	name := nftTableName(domName)
+	table := "ip " + name
+	script := &strings.Builder{}
+	script.WriteString("set -e\n")
+	fmt.Fprintf(script, "if nft list chain %s >/dev/null 2>&1; then\n", libvirtNftChain)
+	fmt.Fprintf(script, "\tnft -a list chain %s | sed -n 's/.*comment \"%s\" # handle \\([0-9]*\\)$/\\1/p' | while read -r handle; do\n", libvirtNftChain, name)
+	fmt.Fprintf(script, "\t\tnft delete rule %s handle \"$handle\"\n\tdone\nfi\n", libvirtNftChain)
+	fmt.Fprintf(script, "if iptables -S %s >/dev/null 2>&1; then\n", libvirtIptablesChain)
+	fmt.Fprintf(script, "\tiptables -S %s | grep -e '--comment %s ' | sed 's/^-A/-D/' | while read -r rule; do\n", libvirtIptablesChain, name)
+	script.WriteString("\t\tiptables $rule\n\tdone\nfi\n")
+	// declaring the table first makes the delete succeed when it doesn't exist yet
+	script.WriteString("nft -f - <<'EOF'\n")
+	script.WriteString("table " + table + "\ndelete table " + table + "\n")
+	if len(forwards) == 0 {
+		script.WriteString("EOF\n")
+		return script.String()
+	}
+	dnat, local := "", ""
+	for _, pf := range forwards {
+		dnat += fmt.Sprintf("\t\tfib daddr type local %s dport %d dnat to %s:%d\n", pf.Proto, pf.HostPort, addr, pf.Port)
+		// the hypervisor's own connections to its addresses, loopback can't be routed to the domain
+		local += fmt.Sprintf("\t\tfib daddr type local ip daddr != 127.0.0.0/8 %s dport %d dnat to %s:%d\n", pf.Proto, pf.HostPort, addr, pf.Port)
+	}
+	script.WriteString("table " + table + " {\n" +
+		"\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n" + dnat + "\t}\n" +
+		"\tchain output {\n\t\ttype nat hook output priority dstnat; policy accept;\n" + local + "\t}\n" +
+		"}\nEOF\n")
+	fmt.Fprintf(script, "if nft list chain %s >/dev/null 2>&1; then\n", libvirtNftChain)
+	for _, pf := range forwards {
+		fmt.Fprintf(script, "\tnft insert rule %s ip daddr %s %s dport %d ct status dnat accept comment \\\"%s\\\"\n",
+			libvirtNftChain, addr, pf.Proto, pf.Port, name)
+	}
+	fmt.Fprintf(script, "fi\nif iptables -S %s >/dev/null 2>&1; then\n", libvirtIptablesChain)
+	for _, pf := range forwards {
+		fmt.Fprintf(script, "\tiptables -I %s -d %s -p %s --dport %d -m conntrack --ctstate DNAT -m comment --comment %s -j ACCEPT\n",
+			libvirtIptablesChain, addr, pf.Proto, pf.Port, name)
+	}
+	script.WriteString("fi\n")
+	return script.String()
+}
+
+// portForwardsCommand runs the PortForwardsScript on the hypervisor as root
+func (c *Config) portForwardsCommand() []string {
+	command := []string{}
+	if c.Sudo != "" {
+		command = append(command, c.Sudo)
+	}
+	return append(command, "sh", "-s")
+}
+
+// initPortForwards applies the PortForwards targeting the domain as nftables rules on the hypervisor
+func (c *Config) initPortForwards(ctx context.Context) error {
+	if len(c.PortForwards) == 0 {
+		return nil
+	} else if c.GetNetMode() != netModeNAT {
+		log.Printf("WARN: port forwards require net mode %q, not %q", netModeNAT, c.GetNetMode())
+		return nil
+	}
+	pfs, err := ParsePortForwards(c.PortForwards)
+	if err != nil {
+		return err
+	}
+	domForwards := []portForward{}
+	for _, pf := range pfs {
+		if pf.Domain == c.Name {
+			domForwards = append(domForwards, pf)
+		}
+	}
+	if len(domForwards) == 0 {
+		return c.delPortForwards(ctx)
+	}
+	// the forwards are ip family rules, whatever address ssh prefers
+	addrs, err := c.getDomainIPAddresses(c.dom)
+	if err != nil {
+		return err
+	}
+	addr := ""
+	for _, a := range addrs {
+		if ip, err := netip.ParseAddr(a.Addr); err == nil && ip.Is4() {
+			addr = ip.String()
+			break
+		}
+	}
+	if addr == "" {
+		return fmt.Errorf("port forwards for %q need an IPv4 address, the domain has none", c.Name)
+	}
+	for _, pf := range domForwards {
+		log.Printf("forwarding hypervisor port %d/%s to %q at %s:%d", pf.HostPort, pf.Proto, c.Name, addr, pf.Port)
+	}
+	return execHypervisorScript(ctx, c, PortForwardsScript(c.Name, addr, domForwards), c.portForwardsCommand()...)
+}
+
+func (c *Config) delPortForwards(ctx context.Context) error {
+	if len(c.PortForwards) == 0 || c.GetNetMode() != netModeNAT {
+		return nil
+	}
+	log.Printf("deleting port forwards for %q...", c.Name)
+	return execHypervisorScript(ctx, c, PortForwardsScript(c.Name, "", nil), c.portForwardsCommand()...)
+}
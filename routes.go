@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	routeAdded    = "added"
+	routeDeleted  = "deleted"
+	routeExists   = "exists"
+	routeAbsent   = "absent"
+	routeConflict = "conflict"
+	routeFailed   = "failed"
+)
+
+var errRoutesUnsupported = errors.New("netlink routes are not supported on this platform")
+
+type (
+	Route struct {
+		Dst     netip.Prefix
+		Gateway netip.Addr // invalid for directly connected routes
+	}
+	RouteResult struct {
+		Route  string // route as configured
+		Status string // added, deleted, exists, absent, conflict or failed
+		Via    string // "netlink", or the fallback command
+		Err    error
+	}
+)
+
+// ParseRoute parses "prefix via gateway" routes
+func ParseRoute(route string) (Route, error) {
+	fields := strings.Fields(route)
+	if len(fields) != 3 || fields[1] != "via" {
+		return Route{}, fmt.Errorf("route %q is not \"prefix via gateway\"", route)
+	}
+	dst, err := netip.ParsePrefix(fields[0])
+	if err != nil {
+		return Route{}, err
+	}
+	gw, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return Route{}, err
+	} else if dst.Addr().Is4() != gw.Is4() {
+		return Route{}, fmt.Errorf("route %q mixes address families", route)
+	}
+	return Route{Dst: dst.Masked(), Gateway: gw}, nil
+}
+
+func (r Route) String() string {
+	if !r.Gateway.IsValid() {
+		return r.Dst.String()
+	}
+	return r.Dst.String() + " via " + r.Gateway.String()
+}
+
+// findRoute looks up the main table route to the route's destination
+func findRoute(r Route) (*Route, error) {
+	routes, err := listRoutes()
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range routes {
+		if existing.Dst == r.Dst {
+			return &existing, nil
+		}
+	}
+	return nil, nil
+}
+
+// ModifyRoutes adds ("add") or deletes ("del") routes. Existing routes are checked first so
+// adding an existing route or deleting a missing one succeeds, and routes to the same destination
+// through other gateways are reported as conflicts. Routes are changed with netlink, falling back
+// to "<su> ip route" when not permitted (or not supported) and su is set.
+func ModifyRoutes(ctx context.Context, su, command string, routes ...string) ([]RouteResult, error) {
+	results := []RouteResult{}
+	var errs error
+	for _, route := range routes {
+		result := modifyRoute(ctx, su, command, route)
+		log.Printf("  %s route %s: %s (%s)", command, result.Route, result.Status, result.Via)
+		if result.Err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s %s: %w", command, route, result.Err))
+		}
+		results = append(results, result)
+	}
+	return results, errs
+}
+
+func modifyRoute(ctx context.Context, su, command, route string) RouteResult {
+	result := RouteResult{Route: route, Via: "netlink"}
+	r, err := ParseRoute(route)
+	if err != nil {
+		// custom routes with other "ip route" options can't be checked
+		return execRouteCommand(ctx, su, command, route, result)
+	}
+	existing, err := findRoute(r)
+	if errors.Is(err, errRoutesUnsupported) {
+		return execRouteCommand(ctx, su, command, route, result)
+	} else if err != nil {
+		result.Status, result.Err = routeFailed, err
+		return result
+	}
+	switch {
+	case existing != nil && !existing.Gateway.IsValid():
+		result.Status = routeConflict
+		result.Err = fmt.Errorf("route to %s is directly connected", r.Dst)
+		return result
+	case existing != nil && existing.Gateway != r.Gateway:
+		result.Status = routeConflict
+		result.Err = fmt.Errorf("route to %s already exists via %s", r.Dst, existing.Gateway)
+		return result
+	case command == "add" && existing != nil:
+		result.Status = routeExists
+		return result
+	case command == "del" && existing == nil:
+		result.Status = routeAbsent
+		return result
+	}
+	if err := netlinkRoute(command, r); errors.Is(err, syscall.EPERM) || errors.Is(err, errRoutesUnsupported) {
+		return execRouteCommand(ctx, su, command, route, result)
+	} else if err != nil {
+		result.Status, result.Err = routeFailed, err
+		return result
+	}
+	result.Status = routeAdded
+	if command == "del" {
+		result.Status = routeDeleted
+	}
+	return result
+}
+
+// execRouteCommand is the fallback for unprivileged users, running "ip route" with su (i.e. sudo)
+func execRouteCommand(ctx context.Context, su, command, route string, result RouteResult) RouteResult {
+	args := append([]string{"ip", "route", command}, strings.Fields(route)...)
+	if su != "" {
+		args = append([]string{su}, args...)
+	} else if os.Geteuid() != 0 {
+		result.Status = routeFailed
+		result.Err = fmt.Errorf("not permitted to %s routes (see config Sudo)", command)
+		return result
+	}
+	result.Via = strings.Join(args, " ")
+	if err := execArgs(ctx, "", args...); err != nil {
+		result.Status, result.Err = routeFailed, err
+		return result
+	}
+	result.Status = routeAdded
+	if command == "del" {
+		result.Status = routeDeleted
+	}
+	return result
+}
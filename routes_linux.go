@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"syscall"
+)
+
+// rtmsg fields, see rtnetlink(7)
+const (
+	rtmFamily = iota
+	rtmDstLen
+	rtmSrcLen
+	rtmTos
+	rtmTable
+	rtmProtocol
+	rtmScope
+	rtmType
+)
+
+// listRoutes lists the unicast routes of the main routing table, directly connected ones have no gateway
+func listRoutes() ([]Route, error) {
+	routes := []Route{}
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+		if err != nil {
+			return nil, os.NewSyscallError("netlinkrib", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rib)
+		if err != nil {
+			return nil, os.NewSyscallError("parsenetlinkmessage", err)
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+				continue
+			} else if msg.Data[rtmTable] != syscall.RT_TABLE_MAIN || msg.Data[rtmType] != syscall.RTN_UNICAST {
+				continue
+			}
+			attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+			if err != nil {
+				return nil, os.NewSyscallError("parsenetlinkrouteattr", err)
+			}
+			dst, gw := netip.IPv4Unspecified(), netip.Addr{}
+			if family == syscall.AF_INET6 {
+				dst = netip.IPv6Unspecified()
+			}
+			for _, attr := range attrs {
+				switch attr.Attr.Type {
+				case syscall.RTA_DST:
+					dst, _ = netip.AddrFromSlice(attr.Value)
+				case syscall.RTA_GATEWAY:
+					gw, _ = netip.AddrFromSlice(attr.Value)
+				}
+			}
+			prefix, err := dst.Prefix(int(msg.Data[rtmDstLen]))
+			if err != nil {
+				return nil, err
+			}
+			routes = append(routes, Route{Dst: prefix, Gateway: gw})
+		}
+	}
+	return routes, nil
+}
+
+func netlinkRouteAttr(attrType uint16, value []byte) []byte {
+	attr := make([]byte, syscall.SizeofRtAttr, syscall.SizeofRtAttr+len(value)+3)
+	binary.NativeEndian.PutUint16(attr[0:2], uint16(syscall.SizeofRtAttr+len(value)))
+	binary.NativeEndian.PutUint16(attr[2:4], attrType)
+	attr = append(attr, value...)
+	// attributes are 4 byte aligned
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+	return attr
+}
+
+// netlinkRoute adds ("add") or deletes ("del") a route in the main routing table
+func netlinkRoute(command string, r Route) error {
+	msgType, flags := uint16(syscall.RTM_NEWROUTE), uint16(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	if command == "del" {
+		msgType, flags = syscall.RTM_DELROUTE, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK
+	} else if command != "add" {
+		return fmt.Errorf("unknown route command %q", command)
+	}
+	family := byte(syscall.AF_INET)
+	if r.Dst.Addr().Is6() {
+		family = syscall.AF_INET6
+	}
+	rtm := make([]byte, syscall.SizeofRtMsg)
+	rtm[rtmFamily] = family
+	rtm[rtmDstLen] = byte(r.Dst.Bits())
+	rtm[rtmTable] = syscall.RT_TABLE_MAIN
+	rtm[rtmType] = syscall.RTN_UNICAST
+	if command == "add" {
+		rtm[rtmProtocol] = syscall.RTPROT_BOOT
+		rtm[rtmScope] = syscall.RT_SCOPE_UNIVERSE
+	} else {
+		rtm[rtmScope] = syscall.RT_SCOPE_NOWHERE
+	}
+	body := append(rtm, netlinkRouteAttr(syscall.RTA_DST, r.Dst.Addr().AsSlice())...)
+	body = append(body, netlinkRouteAttr(syscall.RTA_GATEWAY, r.Gateway.AsSlice())...)
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	msg := make([]byte, syscall.SizeofNlMsghdr, syscall.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(syscall.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags)
+	binary.NativeEndian.PutUint32(msg[8:12], 1)
+	msg = append(msg, body...)
+	if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return os.NewSyscallError("parsenetlinkmessage", err)
+		}
+		for _, reply := range replies {
+			if reply.Header.Type != syscall.NLMSG_ERROR || len(reply.Data) < 4 {
+				continue
+			}
+			// the ack is an error message with errno 0
+			if errno := int32(binary.NativeEndian.Uint32(reply.Data[0:4])); errno != 0 {
+				return os.NewSyscallError("netlink "+command+" route", syscall.Errno(-errno))
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+func listRoutes() ([]Route, error) {
+	return nil, errRoutesUnsupported
+}
+
+func netlinkRoute(command string, r Route) error {
+	return errRoutesUnsupported
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+const (
+	rsyncMetadataURI  = "http://libvirt-dev/xmlns/rsync/1.0"
+	rsyncMetadataKey  = "lvdev"
+	runViaRsync       = "rsync"
+	rsyncPollInterval = time.Second
+	rsyncDebounce     = 2 * time.Second // quiet time after the last change before syncing again
+)
+
+var (
+	rsyncOptions = []string{
+		"-a",
+	}
+	// ignore files in the local dir turned into rsync filter rules, later files take precedence
+	rsyncIgnoreFiles = []string{".gitignore", ".lvdevignore"}
+	// a pull only honors .lvdevignore, .gitignore'd build artifacts are usually what is pulled
+	rsyncPullIgnoreFiles = []string{".lvdevignore"}
+)
+
+type (
+	// ignoreRule is a .gitignore style pattern
+	ignoreRule struct {
+		pattern  string
+		negate   bool // "!pattern" re-includes
+		anchored bool // matched from the top of the dir instead of any depth
+		dirOnly  bool // "pattern/" only matches directories
+	}
+	// domainRsync overrides RemoteDir and RsyncOptions for a domain when syncing many domains
+	domainRsync struct {
+		XMLName   xml.Name `xml:"rsync"`
+		RemoteDir string   `xml:"remoteDir,omitempty"`
+		Options   []string `xml:"option"`
+	}
+)
+
+// parseIgnoreRules parses .gitignore syntax, "**" other than a leading "**/" is passed to rsync as is
+func parseIgnoreRules(data string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// a leading "**/" matches at any depth, the same as an unanchored rsync pattern
+		anyDepth := strings.HasPrefix(line, "**/")
+		line = strings.TrimPrefix(line, "**/")
+		// a slash anywhere but the end anchors the pattern in .gitignore, rsync only anchors a leading one
+		if !anyDepth && strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// loadIgnoreRules reads the ignore files (rsyncIgnoreFiles or rsyncPullIgnoreFiles) in localDir, missing files are skipped
+func loadIgnoreRules(localDir string, files []string) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(localDir, name))
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		rules = append(rules, parseIgnoreRules(string(data))...)
+	}
+	return rules, nil
+}
+
+// rsyncFilters turns ignore rules into rsync --filter args, root is the name the transfer adds
+// in front of anchored paths (src without a trailing slash copies the dir itself)
+func rsyncFilters(rules []ignoreRule, src string) []string {
+	root := ""
+	if base := path.Base(filepath.ToSlash(src)); src != "" && !strings.HasSuffix(src, "/") && base != "." && base != ".." {
+		root = "/" + base
+	}
+	// the last matching .gitignore rule wins, the first matching rsync rule wins
+	args := make([]string, 0, len(rules))
+	for i := len(rules) - 1; i >= 0; i-- {
+		r := rules[i]
+		rule := "- "
+		if r.negate {
+			rule = "+ "
+		}
+		if r.anchored {
+			rule += root + "/"
+		}
+		rule += r.pattern
+		if r.dirOnly {
+			rule += "/"
+		}
+		args = append(args, "--filter="+rule)
+	}
+	return args
+}
+
+// isIgnored matches rel (slash separated, relative to the dir) like git, without "**" support
+// other than a leading "**/"
+func isIgnored(rules []ignoreRule, rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if matchesIgnoreRule(r, rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// matchesIgnoreRule matches an anchored rule against all of rel, others against each trailing run of its
+// path elements, so "b" and "a/b" both match "x/a/b"
+func matchesIgnoreRule(r ignoreRule, rel string) bool {
+	for name := rel; ; {
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return true
+		}
+		_, tail, found := strings.Cut(name, "/")
+		if r.anchored || !found {
+			return false
+		}
+		name = tail
+	}
+}
+
+// rsyncArgs builds the rsync command line for the loaded domain at addr, sshOptions are added to its --rsh
+func (c *Config) rsyncArgs(addr, localDir string, pull bool, sshOptions ...string) ([]string, error) {
+	options, err := c.domainSSHOptions(c.Name)
+	if err != nil {
+		return nil, err
+	}
+	ignoreFiles := rsyncIgnoreFiles
+	if pull {
+		ignoreFiles = rsyncPullIgnoreFiles
+	}
+	rules, err := loadIgnoreRules(localDir, ignoreFiles)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"rsync"}
+	if c.Verbose {
+		args = append(args, "-v", "--progress")
+	}
+	args = append(args, rsyncOptions...)
+	args = append(args, c.RsyncOptions...)
+	// rsync splits --rsh itself, honoring quotes
+	rsh := append(append([]string{"ssh"}, options...), sshOptions...)
+	args = append(args, "--rsh="+quoteArgs(rsh))
+	remote := c.GetUsername() + "@" + SSHHost(addr) + ":" + c.RemoteDir
+	if pull {
+		args = append(args, rsyncFilters(rules, c.RemoteDir)...)
+		args = append(args, remote, localDir)
+	} else {
+		args = append(args, rsyncFilters(rules, localDir)...)
+		args = append(args, localDir, remote)
+	}
+	return args, nil
+}
+
+// doRsync copies localDir to the domain's RemoteDir, or RemoteDir into localDir when pull is set
+func doRsync(ctx context.Context, c *Config, localDir string, pull bool) error {
+	if c.dom == nil {
+		return errors.New("domain not loaded")
+	}
+	c, err := c.withDomainRsync(c.dom)
+	if err != nil {
+		return err
+	}
+	if pull {
+		log.Printf("attempting rsync %q from domain %q to %q...", c.RemoteDir, c.Name, localDir)
+	} else {
+		log.Printf("attempting rsync %q to domain %q...", localDir, c.Name)
+	}
+	addr, err := c.getDomainIPAddress(c.dom)
+	if err != nil {
+		return err
+	} else if err := c.ensureHostKeys(); err != nil {
+		return err
+	}
+	args, err := c.rsyncArgs(addr.Addr, localDir, pull)
+	if err != nil {
+		return err
+	}
+	if c.Verbose {
+		log.Printf("rsync command:\n  %s", quoteArgs(args))
+	}
+	log.Printf("connecting to domain %q at %q", c.Name, c.GetUsername()+"@"+addr.Addr)
+	return execCommand(ctx, args...)
+}
+
+// initRsyncMetadata writes RemoteDir and RsyncOptions to the domain metadata, to sync many domains
+// created from different configs with one rsync command
+func (c *Config) initRsyncMetadata() error {
+	if c.RemoteDir == "" && len(c.RsyncOptions) == 0 {
+		return nil
+	}
+	log.Printf("setting rsync metadata for %q", c.Name)
+	rsyncXML, err := xml.Marshal(domainRsync{RemoteDir: c.RemoteDir, Options: c.RsyncOptions})
+	if err != nil {
+		return err
+	}
+	return c.dom.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, string(rsyncXML), rsyncMetadataKey, rsyncMetadataURI, libvirt.DOMAIN_AFFECT_CONFIG)
+}
+
+// GetDomainRsync reads the rsync overrides from the domain metadata, nil without any
+func GetDomainRsync(dom *libvirt.Domain) (*domainRsync, error) {
+	rsyncXML, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, rsyncMetadataURI, libvirt.DOMAIN_AFFECT_CONFIG)
+	if IsErrorCode(err, libvirt.ERR_NO_DOMAIN_METADATA) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	override := &domainRsync{}
+	if err := xml.Unmarshal([]byte(rsyncXML), override); err != nil {
+		return nil, err
+	}
+	return override, nil
+}
+
+// withDomainRsync returns a copy of c with the domain's rsync metadata applied. The metadata records the config
+// the domain was created from, so it takes precedence for one domain and many alike
+func (c *Config) withDomainRsync(dom *libvirt.Domain) (*Config, error) {
+	dc := *c
+	override, err := GetDomainRsync(dom)
+	if err != nil {
+		return nil, err
+	} else if override != nil {
+		if override.RemoteDir != "" {
+			dc.RemoteDir = override.RemoteDir
+		}
+		if len(override.Options) > 0 {
+			dc.RsyncOptions = override.Options
+		}
+	}
+	return &dc, nil
+}
+
+// rsyncDomains copies localDir to the selected domains, at most parallel at a time, and reports the results
+func (c *Config) rsyncDomains(ctx context.Context, selector string, parallel int, localDir string) error {
+	doms, err := c.resolveDomains("rsync", selector)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, dom := range doms {
+			dom.Free()
+		}
+	}()
+	log.Printf("attempting rsync %q to %d domain(s)...", localDir, len(doms))
+	mu := &sync.Mutex{}
+	done := 0
+	results := parallelDomains(doms, parallel, func(dom *libvirt.Domain) runResult {
+		result := c.rsyncDomain(ctx, dom, mu, localDir)
+		mu.Lock()
+		done++
+		log.Printf("rsync to %q finished (%d/%d)", result.Domain, done, len(doms))
+		mu.Unlock()
+		return result
+	})
+	return reportRunResults(os.Stdout, "rsync", results)
+}
+
+// rsyncDomain copies localDir to one of many domains, its output prefixed with the domain name
+func (c *Config) rsyncDomain(ctx context.Context, dom *libvirt.Domain, mu *sync.Mutex, localDir string) runResult {
+	domName, _ := dom.GetName()
+	result := runResult{Domain: domName, Via: runViaRsync, ExitCode: -1}
+	stdout := &prefixWriter{mu: mu, w: os.Stdout, prefix: domName + ": "}
+	stderr := &prefixWriter{mu: mu, w: os.Stderr, prefix: domName + ": "}
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	// a copy of the config for the domain, it shares the connection
+	dc, err := c.withDomainRsync(dom)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	dc.Name, dc.dom = domName, dom
+	addr, err := dc.getDomainIPAddress(dom)
+	if err != nil {
+		result.Err = err
+		return result
+	} else if err := dc.ensureHostKeys(); err != nil {
+		result.Err = err
+		return result
+	}
+	// no password prompts, the syncs run at once
+	args, err := dc.rsyncArgs(addr.Addr, localDir, false, "-oBatchMode=yes")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if c.Verbose {
+		log.Printf("rsync command:\n  %s", quoteArgs(args))
+	}
+	log.Printf("rsync to %q at %q:%q", domName, addr.Addr, dc.RemoteDir)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err == nil {
+		result.ExitCode = 0
+	} else if ctx.Err() != nil {
+		result.Err = ctx.Err()
+	} else {
+		result.Err = err
+	}
+	return result
+}
+
+type fileState struct {
+	size    int64
+	modTime int64
+}
+
+// snapshotDir records size and mtime of everything not ignored under dir, .git is always skipped
+func snapshotDir(dir string, rules []ignoreRule) (map[string]fileState, error) {
+	snap := map[string]fileState{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed while walking
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && (d.Name() == ".git" || isIgnored(rules, rel, d.IsDir())) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		snap[rel] = fileState{size: info.Size(), modTime: info.ModTime().UnixNano()}
+		return nil
+	})
+	return snap, err
+}
+
+// watchRsync pushes localDir, then polls it and pushes again once changes settle, until ctx is done
+func watchRsync(ctx context.Context, c *Config, localDir string) error {
+	rules, err := loadIgnoreRules(localDir, rsyncIgnoreFiles)
+	if err != nil {
+		return err
+	}
+	last, err := snapshotDir(localDir, rules)
+	if err != nil {
+		return err
+	}
+	if err := doRsync(ctx, c, localDir, false); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("WARN: rsync failed: %v", err)
+	}
+	log.Printf("watching %q for changes...", localDir)
+	ticker := time.NewTicker(rsyncPollInterval)
+	defer ticker.Stop()
+	var changed time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		// the ignore files may have changed too
+		if rules, err = loadIgnoreRules(localDir, rsyncIgnoreFiles); err != nil {
+			log.Printf("WARN: failed to read ignore files: %v", err)
+			continue
+		}
+		snap, err := snapshotDir(localDir, rules)
+		if err != nil {
+			log.Printf("WARN: failed to scan %q: %v", localDir, err)
+			continue
+		}
+		if !maps.Equal(snap, last) {
+			last = snap
+			changed = time.Now()
+			continue
+		} else if changed.IsZero() || time.Since(changed) < rsyncDebounce {
+			continue
+		}
+		changed = time.Time{}
+		if err := doRsync(ctx, c, localDir, false); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("WARN: rsync failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules := parseIgnoreRules("# build output\n*.o\n/bin\n**/gen/out\ndocs/tmp\ncache/\n!keep.o\n")
+	tests := []struct {
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.o", false, true},
+		{"src/a.o", false, true},
+		{"src/keep.o", false, false},
+		{"bin", true, true},
+		{"src/bin", true, false},
+		{"gen/out", true, true},
+		{"src/gen/out", true, true},
+		{"src/gen/out2", true, false},
+		{"docs/tmp", true, true},
+		{"src/docs/tmp", true, false},
+		{"cache", true, true},
+		{"cache", false, false},
+		{"src/cache", true, true},
+	}
+	for _, tt := range tests {
+		if got := isIgnored(rules, tt.rel, tt.isDir); got != tt.ignored {
+			t.Errorf("isIgnored(%s, dir %v) = %v, want %v", tt.rel, tt.isDir, got, tt.ignored)
+		}
+	}
+
+	want := []string{
+		"--filter=+ keep.o",
+		"--filter=- cache/",
+		"--filter=- /src/docs/tmp",
+		"--filter=- gen/out",
+		"--filter=- /src/bin",
+		"--filter=- *.o",
+	}
+	if got := rsyncFilters(rules, "./src"); !slices.Equal(got, want) {
+		t.Errorf("rsyncFilters(./src) = %q, want %q", got, want)
+	}
+}
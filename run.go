@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	labelsMetadataURI = "http://libvirt-dev/xmlns/labels/1.0"
+	labelsMetadataKey = "lvdev"
+	defaultParallel   = 8
+	guestRunTimeout   = 600 // seconds, for commands run with the guest agent
+	runViaSSH         = "ssh"
+	runViaGuestAgent  = "agent"
+)
+
+type (
+	domainLabels struct {
+		XMLName xml.Name      `xml:"labels"`
+		Labels  []domainLabel `xml:"label"`
+	}
+	domainLabel struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:",chardata"`
+	}
+	runResult struct {
+		Domain   string
+		Via      string
+		ExitCode int
+		Err      error
+	}
+	// prefixWriter prefixes each complete line, lines of several writers sharing mu don't interleave.
+	// A "\r" ends a line too, so progress output is passed on as it is updated
+	prefixWriter struct {
+		mu     *sync.Mutex
+		w      io.Writer
+		prefix string
+		buf    []byte
+		cr     bool // the last line written ended with "\r"
+	}
+)
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexAny(p.buf, "\r\n")
+		if i < 0 {
+			return len(data), nil
+		}
+		end := i + 1
+		if p.buf[i] == '\r' && end < len(p.buf) && p.buf[end] == '\n' {
+			end++
+		}
+		// a bare "\r" returns to the start of the line and a bare "\n" ends a progress line, neither gets a prefix
+		prefix := p.prefix
+		if i == 0 && (p.cr || (end == 1 && p.buf[0] == '\r')) {
+			prefix = ""
+		}
+		p.cr = p.buf[end-1] == '\r'
+		p.mu.Lock()
+		_, err := fmt.Fprintf(p.w, "%s%s", prefix, p.buf[:end])
+		p.mu.Unlock()
+		p.buf = p.buf[end:]
+		if err != nil {
+			return len(data), err
+		}
+	}
+}
+
+// Flush writes a last line without a newline, or ends a progress line
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 || p.cr {
+		p.Write([]byte("\n"))
+	}
+}
+
+// ParseLabels parses "key=value,key2=value2" label selectors
+func ParseLabels(selector string) (map[string]string, error) {
+	labels := map[string]string{}
+	if selector == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(selector, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("label %q is not key=value", pair)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// initLabels writes the config Labels to the domain metadata
+func (c *Config) initLabels() error {
+	if len(c.Labels) == 0 {
+		return nil
+	}
+	log.Printf("setting labels for %q", c.Name)
+	labels := domainLabels{}
+	for name, value := range c.Labels {
+		labels.Labels = append(labels.Labels, domainLabel{Name: name, Value: value})
+	}
+	sort.Slice(labels.Labels, func(i, j int) bool {
+		return labels.Labels[i].Name < labels.Labels[j].Name
+	})
+	labelsXML, err := xml.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	return c.dom.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, string(labelsXML), labelsMetadataKey, labelsMetadataURI, libvirt.DOMAIN_AFFECT_CONFIG)
+}
+
+// GetDomainLabels reads the labels from the domain metadata
+func GetDomainLabels(dom *libvirt.Domain) (map[string]string, error) {
+	labelsXML, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, labelsMetadataURI, libvirt.DOMAIN_AFFECT_CONFIG)
+	if IsErrorCode(err, libvirt.ERR_NO_DOMAIN_METADATA) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	labels := domainLabels{}
+	if err := xml.Unmarshal([]byte(labelsXML), &labels); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, label := range labels.Labels {
+		values[label.Name] = label.Value
+	}
+	return values, nil
+}
+
+// selectDomains lists the running domains with names matching the glob pattern and all of the labels
+func (c *Config) selectDomains(pattern string, labels map[string]string) ([]libvirt.Domain, error) {
+	doms, err := c.conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return nil, err
+	}
+	selected := []libvirt.Domain{}
+	for _, dom := range doms {
+		match, err := domainMatches(&dom, pattern, labels)
+		if err != nil || !match {
+			dom.Free()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		selected = append(selected, dom)
+	}
+	return selected, nil
+}
+
+func domainMatches(dom *libvirt.Domain, pattern string, labels map[string]string) (bool, error) {
+	domName, err := dom.GetName()
+	if err != nil {
+		return false, err
+	}
+	if pattern != "" {
+		if match, err := path.Match(pattern, domName); err != nil || !match {
+			return false, err
+		}
+	}
+	if len(labels) == 0 {
+		return true, nil
+	}
+	domLabels, err := GetDomainLabels(dom)
+	if err != nil {
+		return false, err
+	}
+	for key, value := range labels {
+		if v, ok := domLabels[key]; !ok || v != value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// resolveDomains selects the running domains for a command on many domains, by -n glob and -l labels
+func (c *Config) resolveDomains(command, selector string) ([]libvirt.Domain, error) {
+	if c.Name == "" && selector == "" {
+		return nil, fmt.Errorf("%s requires a domain name glob (-n) or labels (-l)", command)
+	}
+	labels, err := ParseLabels(selector)
+	if err != nil {
+		return nil, err
+	}
+	doms, err := c.selectDomains(c.Name, labels)
+	if err != nil {
+		return nil, err
+	} else if len(doms) == 0 {
+		return nil, fmt.Errorf("no running domains match %q %v", c.Name, labels)
+	}
+	return doms, nil
+}
+
+// parallelDomains calls fn for each domain, at most parallel at a time, and returns the results sorted by domain
+func parallelDomains(doms []libvirt.Domain, parallel int, fn func(dom *libvirt.Domain) runResult) []runResult {
+	if parallel < 1 {
+		parallel = defaultParallel
+	}
+	results := make([]runResult, len(doms))
+	sem := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i := range doms {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = fn(&doms[i])
+		}(i)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Domain < results[j].Domain
+	})
+	return results
+}
+
+// reportRunResults writes a summary of the results, and returns an error if any domain failed
+func reportRunResults(w io.Writer, command string, results []runResult) error {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tVIA\tEXIT\tERROR")
+	for _, result := range results {
+		errStr := ""
+		if result.Err != nil {
+			errStr = result.Err.Error()
+		}
+		if result.ExitCode != 0 || result.Err != nil {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", result.Domain, result.Via, result.ExitCode, errStr)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	} else if failed > 0 {
+		return fmt.Errorf("%s failed on %d of %d domain(s)", command, failed, len(results))
+	}
+	return nil
+}
+
+// runDomains runs the command on the selected domains, at most parallel at a time, and reports the exit codes
+func (c *Config) runDomains(ctx context.Context, selector string, parallel int, command []string) error {
+	if len(command) == 0 {
+		return errors.New("no command to run (i.e. run -n 'web-*' -- uptime)")
+	}
+	doms, err := c.resolveDomains("run", selector)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, dom := range doms {
+			dom.Free()
+		}
+	}()
+	mu := &sync.Mutex{}
+	results := parallelDomains(doms, parallel, func(dom *libvirt.Domain) runResult {
+		return c.runDomain(ctx, dom, mu, command)
+	})
+	return reportRunResults(os.Stdout, "command", results)
+}
+
+// runDomain runs the command over ssh, or with the guest agent when ssh can't connect. Once the command may have
+// started it isn't run again, a dropped session or ssh's 255 is the domain's result
+func (c *Config) runDomain(ctx context.Context, dom *libvirt.Domain, mu *sync.Mutex, command []string) runResult {
+	domName, _ := dom.GetName()
+	result := runResult{Domain: domName, Via: runViaSSH, ExitCode: -1}
+	stdout := &prefixWriter{mu: mu, w: os.Stdout, prefix: domName + ": "}
+	stderr := &prefixWriter{mu: mu, w: os.Stderr, prefix: domName + ": "}
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	// a copy of the config for the domain, it shares the connection
+	dc := *c
+	dc.Name, dc.dom = domName, dom
+	err := dc.runSSH(ctx, stdout, stderr, command)
+	var (
+		exitErr       *exec.ExitError
+		nativeExitErr *ssh.ExitError
+		connErr       *SSHConnError
+	)
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		return result
+	} else if errors.As(err, &nativeExitErr) {
+		result.ExitCode = nativeExitErr.ExitStatus()
+		return result
+	} else if err == nil {
+		result.ExitCode = 0
+		return result
+	} else if ctx.Err() != nil {
+		result.Err = ctx.Err()
+		return result
+	} else if !errors.As(err, &connErr) {
+		result.Err = err
+		return result
+	}
+	log.Printf("WARN: ssh to %q failed (%v), running with the guest agent", domName, err)
+	result.Via = runViaGuestAgent
+	status, err := ExecuteGuestCommand(dom, guestRunTimeout, command[0], command[1:]...)
+	if status != nil {
+		stdout.Write(status.OutData)
+		stderr.Write(status.ErrData)
+		if status.Exited {
+			result.ExitCode = status.ExitCode
+			return result
+		}
+	}
+	result.Err = err
+	return result
+}
+
+// runSSH runs the command over ssh, its arguments quoted for the remote shell. Failures before the command
+// could start are returned as an SSHConnError
+func (c *Config) runSSH(ctx context.Context, stdout, stderr io.Writer, command []string) error {
+	if c.NativeSSH {
+		client, err := c.dialDomainSSH(ctx)
+		if err != nil {
+			return sshConnError(c.Name, err)
+		}
+		defer client.Close()
+		return runSSHSession(ctx, client, "", quoteArgs(command), nil, stdout, stderr)
+	}
+	userHost, err := getDomainSSHUserHost(c)
+	if err != nil {
+		return sshConnError(c.Name, err)
+	} else if err := c.ensureHostKeys(); err != nil {
+		return sshConnError(c.Name, err)
+	}
+	options, err := c.domainSSHOptions(c.Name)
+	if err != nil {
+		return sshConnError(c.Name, err)
+	}
+	// no stdin, the command runs on many domains at once
+	options = append(options, "-n", "-oBatchMode=yes")
+	sshArgs := getSSHArgs(c, options, userHost, "")
+	// ssh exits 255 on connection errors and with the command's own 255, connect once without running it to tell
+	preflight := exec.CommandContext(ctx, sshArgs[0], append(sshArgs[1:], "--", "true")...)
+	if out, err := preflight.CombinedOutput(); err != nil {
+		return &SSHConnError{Host: userHost, Op: sshErrConnect, Err: fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))}
+	}
+	sshArgs = append(sshArgs, "--", quoteArgs(command))
+	if c.Verbose {
+		log.Printf("ssh command:\n  %s", quoteArgs(sshArgs))
+	}
+	cmd := exec.CommandContext(ctx, sshArgs[0], sshArgs[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"lines", []string{"a\nb", "c\n\nd"}, "vm: a\nvm: bc\nvm: \nvm: d\n"},
+		{"crlf", []string{"a\r\nb\r", "\n"}, "vm: a\r\nvm: b\r\n"},
+		{"trailing cr progress", []string{"file\n", " 10%\r", " 50%\r", "100%\n"}, "vm: file\nvm:  10%\rvm:  50%\rvm: 100%\n"},
+		{"leading cr progress", []string{"file\n", "\r 10%", "\r 50%", "\r100%\n"}, "vm: file\n\rvm:  10%\rvm:  50%\rvm: 100%\n"},
+		{"progress at exit", []string{" 10%\r"}, "vm:  10%\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &strings.Builder{}
+			p := &prefixWriter{mu: &sync.Mutex{}, w: out, prefix: "vm: "}
+			for _, data := range tt.writes {
+				p.Write([]byte(data))
+			}
+			p.Flush()
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
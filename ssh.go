@@ -1,24 +1,15 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
 	"errors"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
-)
 
-var (
-	sshOptions = []string{
-		"-oStrictHostKeyChecking=no",
-		"-oUserKnownHostsFile=/dev/null",
-	}
-	rsyncOptions = []string{
-		"-a",
-	}
+	"golang.org/x/crypto/ssh"
 )
 
 func getDomainSSHUserHost(c *Config) (string, error) {
@@ -33,9 +24,21 @@ func getDomainSSHUserHost(c *Config) (string, error) {
 	return userHost, nil
 }
 
-func getSSHArgs(c *Config, userHost, subsystem string) []string {
+// getHypervisorSSHUserHost is the hypervisorSSHTarget account for the ssh binary, options set its port
+func getHypervisorSSHUserHost(c *Config) (userHost string, options []string, err error) {
+	username, host, port, err := c.hypervisorSSHTarget()
+	if err != nil {
+		return "", nil, err
+	} else if port != sshPort {
+		options = []string{"-p", port}
+	}
+	return username + "@" + host, options, nil
+}
+
+// getSSHArgs builds the ssh command line, options are the domain host key options (none for the hypervisor)
+func getSSHArgs(c *Config, options []string, userHost, subsystem string) []string {
 	args := []string{"ssh"}
-	args = append(args, sshOptions...)
+	args = append(args, options...)
 	if c.Verbose {
 		args = append(args, "-v")
 	}
@@ -49,96 +52,126 @@ func getSSHArgs(c *Config, userHost, subsystem string) []string {
 func doSSH(ctx context.Context, c *Config, subsystem string) error {
 	log.Printf("attempting ssh to domain %q...", c.Name)
 	userHost, err := getDomainSSHUserHost(c)
+	if err != nil {
+		return err
+	} else if err := c.ensureHostKeys(); err != nil {
+		return err
+	}
+	options, err := c.domainSSHOptions(c.Name)
 	if err != nil {
 		return err
 	}
-	sshArgs := getSSHArgs(c, userHost, subsystem)
-	commandStr := strings.Join(sshArgs, " ")
+	sshArgs := getSSHArgs(c, options, userHost, subsystem)
 	if c.Verbose {
-		log.Printf("ssh command:\n  %s", commandStr)
+		log.Printf("ssh command:\n  %s", quoteArgs(sshArgs))
 	}
 	log.Printf("connecting to domain %q at %q", c.Name, userHost)
-	return execCommand(ctx, commandStr)
+	return execCommand(ctx, sshArgs...)
 }
 
+// doConfigure streams configDir with its .tmpl files rendered to the subsystem, syncconf applies it and
+// syncconf-diff only reports the changes
 func doConfigure(ctx context.Context, c *Config, subsystem, configDir string) error {
 	var (
 		userHost string
+		options  []string
 		err      error
 	)
 	if c.Name == "" {
 		log.Println("attempting to configure hypervisor...")
-		if hypervisorHost, err := c.GetHypervisorHost(); err != nil {
+		if userHost, options, err = getHypervisorSSHUserHost(c); err != nil {
 			return err
-		} else {
-			userHost = c.GetUsername() + "@" + hypervisorHost
 		}
 	} else {
 		log.Printf("attempting to configure domain %q...", c.Name)
 		if userHost, err = getDomainSSHUserHost(c); err != nil {
 			return err
+		} else if err = c.ensureHostKeys(); err != nil {
+			return err
+		} else if options, err = c.domainSSHOptions(c.Name); err != nil {
+			return err
 		}
 	}
-	sshArgs := getSSHArgs(c, userHost, subsystem)
-	if c.Verbose {
-		log.Printf("ssh command:\n  %s", strings.Join(sshArgs, " "))
-	}
 	if c.Name == "" {
 		log.Printf("configuring hypervisor at %q", userHost)
 	} else {
 		log.Printf("configuring domain %q at %q", c.Name, userHost)
 	}
-	cmd := exec.CommandContext(ctx, sshArgs[0], sshArgs[1:]...)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return err
+	// the config dir is streamed to the subsystem as a tar.gz
+	pr, pw := io.Pipe()
+	terr := make(chan error, 1)
+	go func() {
+		err := writeConfigBundle(pw, configDir, c.syncConfData)
+		pw.CloseWithError(err)
+		terr <- err
+	}()
+	defer pr.Close()
+	if c.NativeSSH {
+		err = configureNative(ctx, c, subsystem, pr)
+	} else {
+		sshArgs := getSSHArgs(c, options, userHost, subsystem)
+		if c.Verbose {
+			log.Printf("ssh command:\n  %s", quoteArgs(sshArgs))
+		}
+		cmd := exec.CommandContext(ctx, sshArgs[0], sshArgs[1:]...)
+		cmd.Stdin = pr
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+	}
+	// unblock the tar writer if the transport stopped reading early
+	pr.Close()
+	// a bundle error (i.e. a template) explains a failed transport, unless it's the closed pipe
+	if werr := <-terr; werr != nil && !errors.Is(werr, io.ErrClosedPipe) {
+		return werr
+	}
+	return err
+}
+
+func configureNative(ctx context.Context, c *Config, subsystem string, stdin io.Reader) error {
+	var (
+		client *ssh.Client
+		err    error
+	)
+	if c.Name == "" {
+		client, err = c.dialHypervisorSSH(ctx)
+	} else {
+		client, err = c.dialDomainSSH(ctx)
 	}
-	defer stdin.Close()
-	gz := gzip.NewWriter(stdin)
-	if err := cmd.Start(); err != nil {
+	if err != nil {
 		return err
 	}
-	tr := tar.NewWriter(gz)
-	terr := tr.AddFS(os.DirFS(configDir))
-	if err := tr.Flush(); err != nil {
-		return err
-	} else if err := tr.Close(); err != nil {
-		return err
-	} else if err := gz.Flush(); err != nil {
-		return err
-	} else if err := gz.Close(); err != nil {
-		return err
-	} else if err := cmd.Wait(); err != nil {
-		return err
+	defer client.Close()
+	if c.Verbose {
+		log.Printf("native ssh subsystem %q on %s", subsystem, client.RemoteAddr())
 	}
-	return terr
-
+	return runSSHSession(ctx, client, subsystem, "", stdin, os.Stderr, os.Stderr)
 }
 
-func doRsync(ctx context.Context, c *Config, localDir string) error {
-	log.Printf("attempting rsync %q to domain %q...", localDir, c.Name)
-	if c.dom == nil {
-		return errors.New("domain not loaded")
+// execHypervisorScript runs a command on the hypervisor over ssh, with script as its stdin
+func execHypervisorScript(ctx context.Context, c *Config, script string, command ...string) error {
+	if c.NativeSSH {
+		client, err := c.dialHypervisorSSH(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if c.Verbose {
+			log.Printf("native ssh command on %s:\n  %s\n%s", client.RemoteAddr(), quoteArgs(command), script)
+		}
+		return runSSHSession(ctx, client, "", quoteArgs(command), strings.NewReader(script), os.Stderr, os.Stderr)
 	}
-	addr, err := c.getDomainIPAddress(c.dom)
+	userHost, options, err := getHypervisorSSHUserHost(c)
 	if err != nil {
 		return err
 	}
-	args := []string{"rsync"}
-	if c.Verbose {
-		args = append(args, "-v", "--progress")
-	}
-	args = append(args, rsyncOptions...)
-	args = append(args, c.RsyncOptions...)
-	args = append(args, "--rsh='ssh "+strings.Join(sshOptions, " ")+"'")
-	userHost := c.GetUsername() + "@" + addr.Addr
-	args = append(args, localDir, userHost+":"+c.RemoteDir)
-	commandStr := strings.Join(args, " ")
+	sshArgs := append(getSSHArgs(c, options, userHost, ""), command...)
 	if c.Verbose {
-		log.Printf("rsync command:\n  %s", commandStr)
+		log.Printf("ssh command:\n  %s\n%s", quoteArgs(sshArgs), script)
 	}
-	log.Printf("connecting to domain %q at %q", c.Name, userHost)
-	return execCommand(ctx, commandStr)
+	cmd := exec.CommandContext(ctx, sshArgs[0], sshArgs[1:]...)
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultSSHConfigFile = "~/.ssh/lvdev.conf"
+
+func (c *Config) GetSSHConfigFile() (string, error) {
+	path := c.SSHConfigFile
+	if path == "" {
+		path = defaultSSHConfigFile
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(path, "~/", home+string(os.PathSeparator), 1), nil
+}
+
+// sshConfigBlock delimits the hosts of one libvirt connection, so configs for several hypervisors share the file
+func (c *Config) sshConfigBlock() (begin, end string) {
+	connect := c.managedBlockConnect()
+	return "# BEGIN lvdev " + connect, "# END lvdev " + connect
+}
+
+// IsSSHConnect checks for a libvirt connection over ssh, i.e. qemu+ssh://host/system
+func (c *Config) IsSSHConnect() bool {
+	parts, err := url.Parse(c.Connect)
+	return err == nil && strings.HasSuffix(parts.Scheme, "+ssh")
+}
+
+// hypervisorSSHTarget is the account ssh uses on the hypervisor, for ProxyJump, -syncconf and the hypervisor
+// scripts alike: the Connect URI's user and port with the hypervisor host, else the local user (like libvirt's
+// qemu+ssh) and port 22
+func (c *Config) hypervisorSSHTarget() (username, host, port string, err error) {
+	parts, err := url.Parse(c.Connect)
+	if err != nil {
+		return "", "", "", err
+	}
+	if host, err = c.GetHypervisorHost(); err != nil {
+		return "", "", "", err
+	} else if host == "" {
+		host = parts.Hostname()
+	}
+	if host == "" {
+		return "", "", "", errors.New("no hypervisor host for ssh (see config Connect and Hypervisor)")
+	}
+	if port = parts.Port(); port == "" {
+		port = sshPort
+	}
+	if parts.User != nil && parts.User.Username() != "" {
+		username = parts.User.Username()
+	} else if username, err = currentUsername(); err != nil {
+		return "", "", "", err
+	}
+	return username, host, port, nil
+}
+
+// GetProxyJump is the ssh jump host to reach domains through the hypervisor, see hypervisorSSHTarget
+func (c *Config) GetProxyJump() (string, error) {
+	username, host, port, err := c.hypervisorSSHTarget()
+	if err != nil {
+		return "", err
+	}
+	return username + "@" + net.JoinHostPort(host, port), nil
+}
+
+// preferredAddr picks the IPv4 address, or the IPv6 address when PreferIPv6 is set, like getDomainIPAddress
+func (c *Config) preferredAddr(addrs []string) string {
+	for _, addr := range addrs {
+		if ip, err := netip.ParseAddr(addr); err == nil && ip.Is6() == c.PreferIPv6 {
+			return addr
+		}
+	}
+	return addrs[0]
+}
+
+// SSHConfigHosts renders a Host block per domain with its address, user and pinned host keys
+func (c *Config) SSHConfigHosts(domains []domainAddresses) (string, error) {
+	knownHosts, err := c.GetKnownHostsFile()
+	if err != nil {
+		return "", err
+	}
+	jump := ""
+	if c.ProxyJump || c.IsSSHConnect() {
+		if jump, err = c.GetProxyJump(); err != nil {
+			return "", err
+		}
+	}
+	out := &strings.Builder{}
+	for _, domain := range domains {
+		fmt.Fprintf(out, "Host %s\n", domain.Name)
+		fmt.Fprintf(out, "  HostName %s\n", c.preferredAddr(domain.Addrs))
+		fmt.Fprintf(out, "  User %s\n", c.GetUsername())
+		fmt.Fprintf(out, "  HostKeyAlias %s\n", domain.Name)
+		fmt.Fprintf(out, "  UserKnownHostsFile %q\n", knownHosts)
+		fmt.Fprintf(out, "  StrictHostKeyChecking yes\n")
+		if jump != "" {
+			fmt.Fprintf(out, "  ProxyJump %s\n", jump)
+		}
+	}
+	return out.String(), nil
+}
+
+// hasSSHConfigFile checks whether ssh-config was run, domain changes keep the file current
+func (c *Config) hasSSHConfigFile() bool {
+	path, err := c.GetSSHConfigFile()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// writeSSHConfig writes the Host blocks of the connection's domains to the ssh config include file
+func (c *Config) writeSSHConfig() error {
+	path, err := c.GetSSHConfigFile()
+	if err != nil {
+		return err
+	}
+	log.Printf("checking ssh config hosts in %s...", path)
+	domains, err := c.listDomainAddresses()
+	if err != nil {
+		return err
+	}
+	hosts, err := c.SSHConfigHosts(domains)
+	if err != nil {
+		return err
+	}
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	begin, end := c.sshConfigBlock()
+	updated := replaceManagedBlock(current, begin, end, hosts)
+	if current != nil && bytes.Equal(current, updated) {
+		log.Printf("ssh config hosts up to date (%d hosts)", len(domains))
+	} else if current != nil {
+		log.Printf("updating ssh config hosts (%d hosts)", len(domains))
+		if err := writeFileAtomic(context.Background(), "", path, updated); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("creating ssh config hosts (%d hosts)", len(domains))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		} else if err := os.WriteFile(path, updated, 0600); err != nil {
+			return err
+		}
+	}
+	c.checkSSHConfigInclude(path)
+	return nil
+}
+
+// checkSSHConfigInclude reminds to include the generated file from ~/.ssh/config
+func (c *Config) checkSSHConfigInclude(path string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+	config, err := os.ReadFile(filepath.Join(home, ".ssh", "config"))
+	if err == nil && bytes.Contains(config, []byte(filepath.Base(path))) {
+		return
+	}
+	log.Printf("add this line at the top of ~/.ssh/config to use it:\n\n  Include %s\n", path)
+}
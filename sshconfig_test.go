@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// writing the block again must replace it, not append another copy
+func TestSSHConfigBlockIdempotent(t *testing.T) {
+	hosts := "Host web\n  HostName 192.168.125.10\n  User root\n"
+	tests := []struct {
+		name    string
+		connect string
+		current string
+	}{
+		{"default connect", "", ""},
+		{"ssh connect", "qemu+ssh://root@hv/system", ""},
+		{"other content", "", "Host other\n  HostName 10.0.0.1\n"},
+		{"other hypervisor", "", "# BEGIN lvdev qemu+ssh://hv2/system\nHost db\n# END lvdev qemu+ssh://hv2/system\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Connect: tt.connect}
+			begin, end := c.sshConfigBlock()
+			once := replaceManagedBlock([]byte(tt.current), begin, end, hosts)
+			twice := replaceManagedBlock(once, begin, end, hosts)
+			if !bytes.Equal(once, twice) {
+				t.Errorf("second write changed the file:\n%s\nwant:\n%s", twice, once)
+			}
+			if n := bytes.Count(twice, []byte("Host web\n")); n != 1 {
+				t.Errorf("file has %d copies of the hosts, want 1:\n%s", n, twice)
+			}
+			if !bytes.Contains(twice, []byte(tt.current)) {
+				t.Errorf("file lost the content outside the block:\n%s", twice)
+			}
+			if removed := replaceManagedBlock(twice, begin, end, ""); !bytes.Equal(removed, []byte(tt.current)) {
+				t.Errorf("removing the block left:\n%s\nwant:\n%s", removed, tt.current)
+			}
+		})
+	}
+}
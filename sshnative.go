@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sshPort           = "22"
+	sshDialTimeout    = 15 * time.Second
+	sshErrDial        = "dial"
+	sshErrHandshake   = "handshake"
+	sshErrHostKey     = "host key"
+	sshErrAuth        = "auth"
+	sshErrConnect     = "connect" // the ssh binary failed to run true, or lvdev failed before dialing
+	defaultIdentities = "~/.ssh/id_ed25519 ~/.ssh/id_ecdsa ~/.ssh/id_rsa"
+)
+
+// SSHConnError is a failure to connect over ssh, before any command ran
+type SSHConnError struct {
+	Host string
+	Op   string // dial, handshake, host key or auth
+	Err  error
+}
+
+func (e *SSHConnError) Error() string {
+	return fmt.Sprintf("ssh %s %s: %v", e.Op, e.Host, e.Err)
+}
+
+func (e *SSHConnError) Unwrap() error {
+	return e.Err
+}
+
+// sshConnError returns err as an SSHConnError for host, err is from before any command ran
+func sshConnError(host string, err error) error {
+	var connErr *SSHConnError
+	if errors.As(err, &connErr) {
+		return err
+	}
+	return &SSHConnError{Host: host, Op: sshErrConnect, Err: err}
+}
+
+// sshAuthMethods are the ssh agent keys and the default unencrypted identity files.
+// The agent signs through its socket, closeAgent closes it once the handshake is done
+func sshAuthMethods() (methods []ssh.AuthMethod, closeAgent func()) {
+	signers := []ssh.Signer{}
+	closeAgent = func() {}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			closeAgent = func() { conn.Close() }
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	home, _ := os.UserHomeDir()
+	for _, path := range strings.Fields(defaultIdentities) {
+		key, err := os.ReadFile(strings.Replace(path, "~/", home+string(os.PathSeparator), 1))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, closeAgent
+}
+
+// sshHandshake runs the ssh handshake on conn, classifying failures
+func sshHandshake(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		op := sshErrHandshake
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			op = sshErrHostKey
+		} else if strings.Contains(err.Error(), "unable to authenticate") {
+			op = sshErrAuth
+		}
+		return nil, &SSHConnError{Host: addr, Op: op, Err: err}
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// dialSSH connects to addr as user, through the jump client when set, checking the host key with hostKeyCallback
+func dialSSH(ctx context.Context, jump *ssh.Client, addr, username string, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
+	auth, closeAgent := sshAuthMethods()
+	defer closeAgent()
+	config := &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if jump != nil {
+		conn, err = jump.DialContext(ctx, "tcp", addr)
+	} else {
+		dialer := &net.Dialer{Timeout: sshDialTimeout}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, &SSHConnError{Host: addr, Op: sshErrDial, Err: err}
+	}
+	return sshHandshake(conn, addr, config)
+}
+
+// userKnownHosts checks hosts other than domains (the hypervisor) against ~/.ssh/known_hosts like ssh does
+func userKnownHosts() (ssh.HostKeyCallback, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+}
+
+// dialHypervisorSSH connects to the hypervisor as the hypervisorSSHTarget account
+func (c *Config) dialHypervisorSSH(ctx context.Context) (*ssh.Client, error) {
+	username, host, port, err := c.hypervisorSSHTarget()
+	if err != nil {
+		return nil, err
+	}
+	callback, err := userKnownHosts()
+	if err != nil {
+		return nil, err
+	}
+	return dialSSH(ctx, nil, net.JoinHostPort(host, port), username, callback)
+}
+
+// dialDomainSSH connects to the domain, through the hypervisor with ProxyJump, checking its pinned host keys
+func (c *Config) dialDomainSSH(ctx context.Context) (*ssh.Client, error) {
+	if c.dom == nil {
+		return nil, errors.New("domain not loaded")
+	}
+	addr, err := c.getDomainIPAddress(c.dom)
+	if err != nil {
+		return nil, err
+	} else if err := c.ensureHostKeys(); err != nil {
+		return nil, err
+	}
+	path, err := c.GetKnownHostsFile()
+	if err != nil {
+		return nil, err
+	}
+	pinned, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+	// like HostKeyAlias, the keys are pinned under the domain name
+	callback := func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		return pinned(net.JoinHostPort(c.Name, sshPort), remote, key)
+	}
+	var jump *ssh.Client
+	if c.ProxyJump {
+		if jump, err = c.dialHypervisorSSH(ctx); err != nil {
+			return nil, err
+		}
+	}
+	client, err := dialSSH(ctx, jump, net.JoinHostPort(addr.Addr, sshPort), c.GetUsername(), callback)
+	if jump != nil {
+		if err != nil {
+			jump.Close()
+		} else {
+			// the domain connection is tunnelled through the jump client, close it with the domain client
+			go func() {
+				client.Wait()
+				jump.Close()
+			}()
+		}
+	}
+	return client, err
+}
+
+// runSSHSession runs command (or the subsystem) in a new session, closing the client when ctx is done
+func runSSHSession(ctx context.Context, client *ssh.Client, subsystem, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin, session.Stdout, session.Stderr = stdin, stdout, stderr
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+		case <-done:
+		}
+	}()
+	if subsystem != "" {
+		if err := session.RequestSubsystem(subsystem); err != nil {
+			return err
+		}
+		return session.Wait()
+	}
+	return session.Run(command)
+}
+
+func currentUsername() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+const (
+	syncConfManifest  = "lvdev-manifest.json"
+	syncConfBackupDir = "var/backups/lvdev-syncconf" // under the root, one dir per receive
+	syncConfMaxSize   = 64 << 20                     // bytes of file data, the bundle is held in memory until it's validated
+	syncConfMaxStream = 2 * syncConfMaxSize          // bytes of tar stream, file data with its headers and padding
+	syncConfMaxDiff   = 1 << 22                      // old times new lines, larger files are reported without a diff
+	syncConfTemplate  = ".tmpl"
+)
+
+type (
+	// syncManifest is the optional lvdev-manifest.json at the top of the -syncconf dir
+	syncManifest struct {
+		Files []syncFileMeta // first matching Path wins
+		Hooks []syncHook     // run in order after the files are applied
+	}
+	syncFileMeta struct {
+		Path  string // path.Match glob relative to the root, i.e. "etc/ssh/*"
+		Mode  string // octal, i.e. "0600"
+		Owner string // user name or uid
+		Group string // group name or gid
+	}
+	syncHook struct {
+		Paths   []string // globs, the hook runs when a matching file changed (any file when empty)
+		Command []string // argv, run without a shell
+	}
+	// syncConfData is what .tmpl files in the -syncconf dir are rendered with
+	syncConfData struct {
+		Config  *Config
+		Name    string            // the domain name, empty for the hypervisor
+		IP      string            // the address ssh connects to
+		Domains map[string]string // every domain's address by name
+	}
+	syncBundle struct {
+		entries  []syncEntry
+		manifest *syncManifest
+	}
+	syncEntry struct {
+		name     string // cleaned, relative to the root
+		typeflag byte
+		mode     fs.FileMode
+		data     []byte
+		linkname string
+	}
+)
+
+// receiveConfig is the sshd subsystem end of -syncconf (Subsystem syncconf /path/to/lvdev syncconf-receive):
+// it reads the tar.gz on r, validates all of it, then applies it under root and reports to w. With diff, the end
+// of -syncconf-diff (Subsystem syncconf-diff /path/to/lvdev syncconf-diff), it only reports what would change
+func receiveConfig(r io.Reader, w io.Writer, root string, diff bool) error {
+	bundle, err := readSyncBundle(r)
+	if err != nil {
+		return err
+	}
+	entries, manifest := bundle.entries, bundle.manifest
+	metas, err := resolveSyncMeta(entries, manifest)
+	if err != nil {
+		return err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return err
+	}
+	backupDir := ""
+	if !diff {
+		// a new dir per receive, receives within the same second don't collide
+		parent := filepath.Join(root, filepath.FromSlash(syncConfBackupDir))
+		if err := os.MkdirAll(parent, 0o700); err != nil {
+			return err
+		} else if backupDir, err = os.MkdirTemp(parent, time.Now().Format("20060102-150405")+"-"); err != nil {
+			return err
+		}
+		// kept only when files were backed up
+		defer os.Remove(backupDir)
+	}
+	changed := []string{}
+	counts := map[string]int{}
+	for _, entry := range entries {
+		status, err := applySyncEntry(root, backupDir, entry, metas[entry.name], diff)
+		if err != nil {
+			fmt.Fprintf(w, "failed %s: %v\n", entry.name, err)
+			return err
+		}
+		counts[status]++
+		if status == "unchanged" {
+			continue
+		}
+		changed = append(changed, entry.name)
+		if diff {
+			fmt.Fprintf(w, "would be %s %s\n", status, entry.name)
+			if entry.typeflag == tar.TypeReg {
+				writeSyncDiff(w, root, entry)
+			}
+		} else if entry.typeflag != tar.TypeDir || status == "updated" {
+			fmt.Fprintf(w, "%s %s\n", status, entry.name)
+		}
+	}
+	if diff {
+		hooks := 0
+		for _, hook := range manifest.Hooks {
+			if hookMatches(hook, changed) {
+				fmt.Fprintf(w, "would run hook %s\n", quoteArgs(hook.Command))
+				hooks++
+			}
+		}
+		fmt.Fprintf(w, "syncconf diff: %d to create, %d to update, %d unchanged, %d hook(s) to run\n",
+			counts["created"], counts["updated"], counts["unchanged"], hooks)
+		return nil
+	} else if err := os.Remove(backupDir); err != nil {
+		// not empty, files were replaced
+		fmt.Fprintf(w, "backups in %s\n", backupDir)
+	}
+	failed := 0
+	for _, hook := range manifest.Hooks {
+		if !hookMatches(hook, changed) {
+			continue
+		}
+		fmt.Fprintf(w, "hook %s\n", quoteArgs(hook.Command))
+		cmd := exec.Command(hook.Command[0], hook.Command[1:]...)
+		cmd.Stdout = w
+		cmd.Stderr = w
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(w, "hook %s failed: %v\n", quoteArgs(hook.Command), err)
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "syncconf: %d created, %d updated, %d unchanged, %d hook(s) failed\n",
+		counts["created"], counts["updated"], counts["unchanged"], failed)
+	if failed > 0 {
+		return fmt.Errorf("%d hook(s) failed", failed)
+	}
+	return nil
+}
+
+// readSyncBundle reads and validates every entry, nothing is written before the whole bundle is checked
+func readSyncBundle(r io.Reader) (*syncBundle, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	// the file data is limited by size, this only guards against endless headers
+	stream := &io.LimitedReader{R: gz, N: syncConfMaxStream + 1}
+	tooLarge := func(err error) error {
+		if stream.N <= 0 {
+			return fmt.Errorf("bundle stream is larger than %d bytes", syncConfMaxStream)
+		}
+		return err
+	}
+	tr := tar.NewReader(stream)
+	entries := []syncEntry{}
+	manifest := &syncManifest{}
+	size := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			// a cut off stream may end on a header boundary
+			if err := tooLarge(nil); err != nil {
+				return nil, err
+			}
+			break
+		} else if err != nil {
+			return nil, tooLarge(err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		} else if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return nil, fmt.Errorf("%q is outside the root", hdr.Name)
+		}
+		entry := syncEntry{name: name, typeflag: hdr.Typeflag, mode: fs.FileMode(hdr.Mode).Perm()}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeReg:
+			if size += int(hdr.Size); size > syncConfMaxSize {
+				return nil, fmt.Errorf("bundle is larger than %d bytes", syncConfMaxSize)
+			}
+			if entry.data, err = io.ReadAll(tr); err != nil {
+				return nil, tooLarge(err)
+			}
+		case tar.TypeSymlink:
+			if path.IsAbs(hdr.Linkname) {
+				return nil, fmt.Errorf("symlink %q has an absolute target %q", name, hdr.Linkname)
+			} else if target := path.Join(path.Dir(name), hdr.Linkname); !filepath.IsLocal(filepath.FromSlash(target)) {
+				return nil, fmt.Errorf("symlink %q points outside the root", name)
+			}
+			entry.linkname = hdr.Linkname
+		default:
+			return nil, fmt.Errorf("%q has unsupported type %q", name, hdr.Typeflag)
+		}
+		if name == syncConfManifest {
+			if err := json.Unmarshal(entry.data, manifest); err != nil {
+				return nil, fmt.Errorf("%s: %w", syncConfManifest, err)
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	// entries are applied in order, a symlink in the bundle must not redirect a later entry
+	links := map[string]bool{}
+	for _, entry := range entries {
+		for dir := path.Dir(entry.name); dir != "."; dir = path.Dir(dir) {
+			if links[dir] {
+				return nil, fmt.Errorf("%q is below the symlink %q", entry.name, dir)
+			}
+		}
+		if entry.typeflag == tar.TypeSymlink {
+			links[entry.name] = true
+		}
+	}
+	for _, hook := range manifest.Hooks {
+		if len(hook.Command) == 0 {
+			return nil, fmt.Errorf("%s: hook without a command", syncConfManifest)
+		}
+	}
+	return &syncBundle{entries: entries, manifest: manifest}, nil
+}
+
+type syncOwner struct {
+	mode     fs.FileMode
+	hasMode  bool
+	uid, gid int // -1 to keep
+}
+
+// resolveSyncMeta looks up the manifest mode and ownership of each entry
+func resolveSyncMeta(entries []syncEntry, manifest *syncManifest) (map[string]syncOwner, error) {
+	metas := map[string]syncOwner{}
+	for _, entry := range entries {
+		owner := syncOwner{uid: -1, gid: -1}
+		for _, meta := range manifest.Files {
+			if match, err := path.Match(meta.Path, entry.name); err != nil {
+				return nil, fmt.Errorf("%s: %w", syncConfManifest, err)
+			} else if !match {
+				continue
+			}
+			if meta.Mode != "" {
+				mode, err := strconv.ParseUint(meta.Mode, 8, 32)
+				if err != nil {
+					return nil, fmt.Errorf("%s: mode %q for %q: %w", syncConfManifest, meta.Mode, meta.Path, err)
+				}
+				owner.mode, owner.hasMode = fs.FileMode(mode).Perm(), true
+			}
+			var err error
+			if owner.uid, err = lookupID(meta.Owner, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			}); err != nil {
+				return nil, err
+			}
+			if owner.gid, err = lookupID(meta.Group, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			}); err != nil {
+				return nil, err
+			}
+			break
+		}
+		metas[entry.name] = owner
+	}
+	return metas, nil
+}
+
+// lookupID resolves a user or group name or numeric id, -1 when empty
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	} else if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+func hookMatches(hook syncHook, changed []string) bool {
+	if len(hook.Paths) == 0 {
+		return len(changed) > 0
+	}
+	for _, name := range changed {
+		for _, pattern := range hook.Paths {
+			if match, _ := path.Match(pattern, name); match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applySyncEntry writes one entry under root and returns created, updated or unchanged, with dryRun
+// it only returns what would happen
+func applySyncEntry(root, backupDir string, entry syncEntry, owner syncOwner, dryRun bool) (string, error) {
+	target := filepath.Join(root, filepath.FromSlash(entry.name))
+	if err := checkInsideRoot(root, filepath.Dir(target)); err != nil {
+		return "", err
+	}
+	mode := entry.mode
+	if owner.hasMode {
+		mode = owner.mode
+	}
+	info, err := os.Lstat(target)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	exists := err == nil
+	switch entry.typeflag {
+	case tar.TypeDir:
+		if exists && !info.IsDir() {
+			return "", fmt.Errorf("%s exists and is not a directory", target)
+		} else if !exists {
+			if dryRun {
+				return "created", nil
+			} else if err := os.MkdirAll(target, mode); err != nil {
+				return "", err
+			} else if err := os.Chmod(target, mode); err != nil {
+				// the create mode is masked by the umask
+				return "", err
+			}
+			return "created", os.Lchown(target, owner.uid, owner.gid)
+		}
+		// existing dirs only get the manifest's mode and owner, not the sender's
+		if (!owner.hasMode || info.Mode().Perm() == owner.mode) && ownedBy(info, owner) {
+			return "unchanged", nil
+		} else if dryRun {
+			return "updated", nil
+		} else if owner.hasMode {
+			if err := os.Chmod(target, owner.mode); err != nil {
+				return "", err
+			}
+		}
+		return "updated", os.Lchown(target, owner.uid, owner.gid)
+	case tar.TypeSymlink:
+		if exists && info.Mode()&fs.ModeSymlink != 0 {
+			if linkname, err := os.Readlink(target); err == nil && linkname == entry.linkname {
+				return "unchanged", nil
+			}
+		}
+		if dryRun {
+			return plannedSyncStatus(target, info)
+		}
+		return replaceSyncFile(target, backupDir, entry.name, info, func(tmp string) error {
+			if err := os.Symlink(entry.linkname, tmp); err != nil {
+				return err
+			}
+			return os.Lchown(tmp, owner.uid, owner.gid)
+		})
+	}
+	if exists && info.Mode().IsRegular() && info.Mode().Perm() == mode && ownedBy(info, owner) {
+		if data, err := os.ReadFile(target); err == nil && bytes.Equal(data, entry.data) {
+			return "unchanged", nil
+		}
+	}
+	if dryRun {
+		return plannedSyncStatus(target, info)
+	}
+	return replaceSyncFile(target, backupDir, entry.name, info, func(tmp string) error {
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		} else if _, err := f.Write(entry.data); err != nil {
+			f.Close()
+			return err
+		} else if err := f.Chmod(mode); err != nil {
+			// the create mode is masked by the umask
+			f.Close()
+			return err
+		} else if err := f.Close(); err != nil {
+			return err
+		} else if owner.uid < 0 && owner.gid < 0 && info != nil {
+			// replaced files keep their owner unless the manifest sets one
+			owner.uid, owner.gid = fileOwner(info)
+		}
+		return os.Lchown(tmp, owner.uid, owner.gid)
+	})
+}
+
+// plannedSyncStatus is what replaceSyncFile would return
+func plannedSyncStatus(target string, info fs.FileInfo) (string, error) {
+	if info == nil {
+		return "created", nil
+	} else if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", target)
+	}
+	return "updated", nil
+}
+
+// replaceSyncFile creates the new file next to target with create, backs up the old one, and renames over it
+func replaceSyncFile(target, backupDir, name string, info fs.FileInfo, create func(tmp string) error) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".lvdev-"+strconv.Itoa(os.Getpid()))
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if info == nil {
+		return "created", os.Rename(tmp, target)
+	} else if info.IsDir() {
+		os.Remove(tmp)
+		return "", fmt.Errorf("%s is a directory", target)
+	} else if err := backupSyncFile(target, filepath.Join(backupDir, filepath.FromSlash(name)), info); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return "updated", os.Rename(tmp, target)
+}
+
+// backupSyncFile copies a file (or symlink) about to be replaced into the backup dir
+func backupSyncFile(target, backup string, info fs.FileInfo) error {
+	if err := os.MkdirAll(filepath.Dir(backup), 0o700); err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		linkname, err := os.Readlink(target)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(linkname, backup)
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(backup, data, info.Mode().Perm())
+}
+
+// checkInsideRoot makes sure dir doesn't resolve outside root through existing symlinks
+func checkInsideRoot(root, dir string) error {
+	// resolve the deepest existing parent, the rest is created as directories
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			dir = filepath.Dir(dir)
+			continue
+		} else if err != nil {
+			return err
+		}
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(resolvedRoot, resolved); err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("%s resolves outside %s", dir, root)
+		}
+		return nil
+	}
+}
+
+func ownedBy(info fs.FileInfo, owner syncOwner) bool {
+	uid, gid := fileOwner(info)
+	return (owner.uid < 0 || owner.uid == uid) && (owner.gid < 0 || owner.gid == gid)
+}
+
+func fileOwner(info fs.FileInfo) (int, int) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid), int(stat.Gid)
+	}
+	return -1, -1
+}
+
+// writeSyncDiff reports how a file in the bundle differs from the one under root
+func writeSyncDiff(w io.Writer, root string, entry syncEntry) {
+	old := []byte{}
+	target := filepath.Join(root, filepath.FromSlash(entry.name))
+	if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() {
+		if old, err = os.ReadFile(target); err != nil {
+			fmt.Fprintf(w, "failed to read %s: %v\n", entry.name, err)
+			return
+		}
+	}
+	if bytes.Equal(old, entry.data) {
+		fmt.Fprintln(w, "mode or owner differs")
+		return
+	}
+	writeUnifiedDiff(w, entry.name, old, entry.data)
+}
+
+// writeUnifiedDiff writes a line diff of old and new with 3 lines of context, like diff -u
+func writeUnifiedDiff(w io.Writer, name string, old, new []byte) {
+	fmt.Fprintf(w, "--- a/%s\n+++ b/%s\n", name, name)
+	if bytes.IndexByte(old, 0) >= 0 || bytes.IndexByte(new, 0) >= 0 {
+		fmt.Fprintln(w, "binary files differ")
+		return
+	}
+	a, b := splitLines(old), splitLines(new)
+	if len(a)*len(b) > syncConfMaxDiff {
+		fmt.Fprintln(w, "files differ (too large to diff)")
+		return
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type diffLine struct {
+		kind byte
+		text string
+		i, j int // line index in old and new before this line
+	}
+	lines := []diffLine{}
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			lines = append(lines, diffLine{' ', a[i], i, j})
+			i, j = i+1, j+1
+		} else if i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]) {
+			lines = append(lines, diffLine{'-', a[i], i, j})
+			i++
+		} else {
+			lines = append(lines, diffLine{'+', b[j], i, j})
+			j++
+		}
+	}
+	const context = 3
+	for k := 0; k < len(lines); {
+		if lines[k].kind == ' ' {
+			k++
+			continue
+		}
+		// a hunk runs until the next change is further than two contexts away
+		end := k
+		for end < len(lines) {
+			if lines[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].kind == ' ' {
+				next++
+			}
+			if next == len(lines) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		start, stop := max(k-context, 0), min(end+context, len(lines))
+		oldCount, newCount := 0, 0
+		for _, line := range lines[start:stop] {
+			if line.kind != '+' {
+				oldCount++
+			}
+			if line.kind != '-' {
+				newCount++
+			}
+		}
+		oldStart, newStart := lines[start].i+1, lines[start].j+1
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, line := range lines[start:stop] {
+			fmt.Fprintf(w, "%c%s", line.kind, line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		k = stop
+	}
+}
+
+// splitLines keeps the newlines, so a last line without one differs from the same line with one
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return []string{}
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// syncConfData collects the template data for the domain (or the hypervisor without a name)
+func (c *Config) syncConfData() (*syncConfData, error) {
+	data := &syncConfData{Config: c, Name: c.Name, Domains: map[string]string{}}
+	if c.Name == "" {
+		host, err := c.GetHypervisorHost()
+		if err != nil {
+			return nil, err
+		}
+		data.IP = host
+	} else if c.dom == nil {
+		return nil, errors.New("domain not loaded")
+	} else {
+		addr, err := c.getDomainIPAddress(c.dom)
+		if err != nil {
+			return nil, err
+		}
+		data.IP = addr.Addr
+	}
+	domains, err := c.listDomainAddresses()
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range domains {
+		if len(domain.Addrs) > 0 {
+			data.Domains[domain.Name] = c.preferredAddr(domain.Addrs)
+		}
+	}
+	return data, nil
+}
+
+// writeConfigBundle writes configDir to w as a tar.gz, .tmpl files rendered and stored without the suffix.
+// templateData is only called for the first .tmpl file, dirs without templates don't need the domain addresses
+func writeConfigBundle(w io.Writer, configDir string, templateData func() (*syncConfData, error)) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	var data *syncConfData
+	err := filepath.WalkDir(configDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(configDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+		}
+		var content []byte
+		switch {
+		case d.IsDir():
+			hdr.Typeflag, hdr.Name = tar.TypeDir, hdr.Name+"/"
+		case info.Mode()&fs.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			if hdr.Linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			if content, err = os.ReadFile(p); err != nil {
+				return err
+			}
+			if strings.HasSuffix(hdr.Name, syncConfTemplate) {
+				hdr.Name = strings.TrimSuffix(hdr.Name, syncConfTemplate)
+				if data == nil {
+					if data, err = templateData(); err != nil {
+						return err
+					}
+				}
+				if content, err = renderSyncTemplate(rel, content, data); err != nil {
+					return err
+				}
+			}
+			hdr.Size = int64(len(content))
+		default:
+			return fmt.Errorf("%s: unsupported file type %s", p, info.Mode().Type())
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = tw.Write(content)
+		return err
+	})
+	if err != nil {
+		return err
+	} else if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func renderSyncTemplate(name string, content []byte, data *syncConfData) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	out := &bytes.Buffer{}
+	if err := tmpl.Execute(out, data); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
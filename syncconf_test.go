@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestApplySyncEntryDir(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(0o022))
+	root := t.TempDir()
+	entry := syncEntry{name: "etc/app", typeflag: tar.TypeDir, mode: 0o775}
+	noOwner := syncOwner{uid: -1, gid: -1}
+	manifest := syncOwner{uid: -1, gid: -1, mode: 0o700, hasMode: true}
+	tests := []struct {
+		name   string
+		owner  syncOwner
+		status string
+		mode   fs.FileMode
+	}{
+		// the bundle's mode despite the umask
+		{"create", noOwner, "created", 0o775},
+		{"existing keeps its mode", noOwner, "unchanged", 0o775},
+		{"manifest mode", manifest, "updated", 0o700},
+		{"manifest mode applied", manifest, "unchanged", 0o700},
+	}
+	for _, tt := range tests {
+		status, err := applySyncEntry(root, "", entry, tt.owner, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		} else if status != tt.status {
+			t.Errorf("%s: status = %s, want %s", tt.name, status, tt.status)
+		}
+		info, err := os.Stat(filepath.Join(root, "etc", "app"))
+		if err != nil {
+			t.Fatal(err)
+		} else if info.Mode().Perm() != tt.mode {
+			t.Errorf("%s: mode = %o, want %o", tt.name, info.Mode().Perm(), tt.mode)
+		}
+	}
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{"changed line", "a\nb\nc\n", "a\nB\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"added newline", "a\nb", "a\nb\n", "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+		{"removed newline", "a\n", "a", "@@ -1,1 +1,1 @@\n-a\n+a\n\\ No newline at end of file\n"},
+		{"new file", "", "a\n", "@@ -0,0 +1,1 @@\n+a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &strings.Builder{}
+			writeUnifiedDiff(out, "etc/f", []byte(tt.old), []byte(tt.new))
+			want := "--- a/etc/f\n+++ b/etc/f\n" + tt.want
+			if got := out.String(); got != want {
+				t.Errorf("diff =\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigBundleDiff(t *testing.T) {
+	configDir, root := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(configDir, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(configDir, "etc", "app.conf"), []byte("a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bundle := &bytes.Buffer{}
+	// no .tmpl files, no template data
+	if err := writeConfigBundle(bundle, configDir, func() (*syncConfData, error) {
+		return nil, errors.New("template data built without a template")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	out := &strings.Builder{}
+	if err := receiveConfig(bytes.NewReader(bundle.Bytes()), out, root, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "would be created etc/app.conf\n") {
+		t.Errorf("diff output:\n%s", out)
+	}
+	if entries, err := os.ReadDir(root); err != nil {
+		t.Fatal(err)
+	} else if len(entries) > 0 {
+		t.Errorf("diff wrote %s", entries[0].Name())
+	}
+}
+
+// syncBundleOf writes a tar.gz with files of the given sizes
+func syncBundleOf(t *testing.T, sizes ...int) []byte {
+	t.Helper()
+	out := &bytes.Buffer{}
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for i, size := range sizes {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("f%d", i), Mode: 0o644, Size: int64(size)}); err != nil {
+			t.Fatal(err)
+		} else if _, err := tw.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// the limit is on file data, headers and padding don't count
+func TestReadSyncBundleLimit(t *testing.T) {
+	sizes := make([]int, 64)
+	for i := range sizes {
+		sizes[i] = 1<<20 - 1
+	}
+	if _, err := readSyncBundle(bytes.NewReader(syncBundleOf(t, sizes...))); err != nil {
+		t.Errorf("bundle just under the limit: %v", err)
+	}
+	sizes = append(sizes, 65)
+	_, err := readSyncBundle(bytes.NewReader(syncBundleOf(t, sizes...)))
+	if err == nil || !strings.Contains(err.Error(), "bundle is larger than") {
+		t.Errorf("bundle over the limit error = %v, want bundle is larger than", err)
+	}
+}